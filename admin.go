@@ -0,0 +1,253 @@
+package dulbecco
+
+import (
+	"fmt"
+	"github.com/piger/dulbecco/markov"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// An admin command receives the arguments following the command name.
+type adminCommand func(c *Connection, message *Message, args []string)
+
+// Commands available to the users matching ServerConfiguration.Admins.
+var adminCommands map[string]adminCommand
+
+// adminCommands is set in init() to break the initialization cycle between
+// the commands and h_admin.
+func init() {
+	adminCommands = map[string]adminCommand{
+		"jobs":   cmdJobs,
+		"job":    cmdJob,
+		"reload": cmdReload,
+		"forget": cmdForget,
+		"purge":  cmdPurge,
+		"markov": cmdMarkov,
+	}
+}
+
+// Dispatch admin commands like "!jobs".
+func (c *Connection) h_admin(message *Message) {
+	text := message.Text()
+	name, args, ok := c.Settings(message.Channel()).ParseCommand(text)
+	if !ok {
+		return
+	}
+	command, ok := adminCommands[strings.ToLower(name)]
+	if !ok {
+		return
+	}
+	if c.permissionLevel(message) != PermissionAdmin {
+		log.Printf("Unauthorized admin command from %s: %s", message.GetFrom(), text)
+		return
+	}
+	command(c, message, strings.Fields(args))
+}
+
+// !jobs: list the scheduled jobs
+func cmdJobs(c *Connection, message *Message, args []string) {
+	target := message.ReplyTarget()
+	scheduler := c.bot.Scheduler()
+
+	jobs := scheduler.Jobs()
+	if len(jobs) == 0 {
+		c.Privmsg(target, "No jobs defined")
+		return
+	}
+	for _, job := range jobs {
+		next := scheduler.NextRun(job)
+		if next.IsZero() {
+			c.Privmsgf(target, "%s: not scheduled", job.Name)
+		} else {
+			c.Privmsgf(target, "%s: next run %s", job.Name, next.Format(time.RFC1123))
+		}
+	}
+}
+
+// !job <name>: run a job now
+func cmdJob(c *Connection, message *Message, args []string) {
+	target := message.ReplyTarget()
+	if len(args) != 1 {
+		c.Privmsg(target, "usage: !job <name>")
+		return
+	}
+
+	scheduler := c.bot.Scheduler()
+	job := scheduler.Job(args[0])
+	if job == nil {
+		c.Privmsgf(target, "No such job: %s", args[0])
+		return
+	}
+	go scheduler.Run(job)
+	c.Privmsgf(target, "Running job %s", job.Name)
+}
+
+// !reload: read the configuration file again
+func cmdReload(c *Connection, message *Message, args []string) {
+	target := message.ReplyTarget()
+
+	// the reload waits for the running callbacks, including this one
+	go func() {
+		if err := c.bot.Reload(); err != nil {
+			log.Print("Configuration reload failed: ", err)
+			c.Privmsgf(target, "Reload failed, keeping the old configuration: %s", err)
+			return
+		}
+		c.Privmsg(target, "Configuration reloaded")
+	}()
+}
+
+// !forget <nick> [channel]: remove what nick said from the markov corpora;
+// provenance is per nick, see markov.Source
+func cmdForget(c *Connection, message *Message, args []string) {
+	target := message.ReplyTarget()
+	corpora := c.bot.Corpora()
+	if len(args) < 1 || len(args) > 2 {
+		c.Privmsg(target, "usage: !forget <nick> [channel]")
+		return
+	} else if corpora == nil {
+		c.Privmsg(target, "No markov database")
+		return
+	}
+	var channel string
+	if len(args) == 2 {
+		channel = args[1]
+	}
+
+	go func() {
+		n, err := forEachCorpus(corpora, func(mdb *markov.MarkovDB) (int, error) {
+			return mdb.Forget(args[0], channel)
+		})
+		if err != nil {
+			log.Printf("Error forgetting %s: %s", args[0], err)
+			c.Privmsgf(target, "Error: %s", err)
+			return
+		}
+		if !corpora.Default().Provenance {
+			c.Privmsgf(target, "Forgot %d transitions of %s; who said what is not being recorded, enable markov.provenance", n, args[0])
+			return
+		}
+		c.Privmsgf(target, "Forgot %d transitions of %s", n, args[0])
+	}()
+}
+
+// !purge <regexp>: remove the transitions matching regexp from the markov
+// corpora
+func cmdPurge(c *Connection, message *Message, args []string) {
+	target := message.ReplyTarget()
+	corpora := c.bot.Corpora()
+	if len(args) == 0 {
+		c.Privmsg(target, "usage: !purge <regexp>")
+		return
+	} else if corpora == nil {
+		c.Privmsg(target, "No markov database")
+		return
+	}
+	re, err := regexp.Compile(strings.Join(args, " "))
+	if err != nil {
+		c.Privmsgf(target, "Invalid regexp: %s", err)
+		return
+	}
+
+	go func() {
+		n, err := forEachCorpus(corpora, func(mdb *markov.MarkovDB) (int, error) {
+			return mdb.Purge(re)
+		})
+		if err != nil {
+			log.Printf("Error purging %s: %s", re, err)
+			c.Privmsgf(target, "Error: %s", err)
+			return
+		}
+		c.Privmsgf(target, "Purged %d transitions", n)
+	}()
+}
+
+// Run fn on every corpus, returning the sum of the results.
+func forEachCorpus(corpora *markov.Corpora, fn func(mdb *markov.MarkovDB) (int, error)) (int, error) {
+	all, err := corpora.All()
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for _, mdb := range all {
+		n, err := fn(mdb)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// !markov stats [corpus]: size and shape of a corpus, by default the one of
+// the channel
+// !markov why <text>: the transitions that can generate text, i.e. a reply
+func cmdMarkov(c *Connection, message *Message, args []string) {
+	target := message.ReplyTarget()
+	corpora := c.bot.Corpora()
+	if len(args) == 0 || (args[0] == "why" && len(args) == 1) {
+		c.Privmsg(target, "usage: !markov stats [corpus] | !markov why <text>")
+		return
+	} else if corpora == nil {
+		c.Privmsg(target, "No markov database")
+		return
+	}
+	settings := c.Settings(message.Channel())
+
+	switch args[0] {
+	case "stats":
+		// the configured corpus is created if needed, like when chatting,
+		// while a corpus typed by hand must exist
+		mdb, err := corpora.Get(settings.MarkovCorpus)
+		if len(args) > 1 {
+			mdb, err = corpora.Lookup(args[1])
+		}
+		if err != nil {
+			c.Privmsgf(target, "Error: %s", err)
+			return
+		}
+		// it reads the whole database
+		go func() {
+			stats, err := mdb.Stats(5)
+			if err != nil {
+				log.Print("Error reading the markov stats: ", err)
+				c.Privmsgf(target, "Error: %s", err)
+				return
+			}
+			var top []string
+			for _, word := range stats.TopWords {
+				top = append(top, fmt.Sprintf("%s (%d)", word.Word, word.Count))
+			}
+			size := "unknown size"
+			if stats.Size >= 0 {
+				size = fmt.Sprintf("%.1f MB", float64(stats.Size)/(1<<20))
+			}
+			c.Privmsgf(target, "%d states, %d transitions, %.2f average branching, %d distinct words out of %d, %s; order %d-%d, %s tokenizer",
+				stats.States, stats.Transitions, stats.Branching, stats.Words, stats.TotalWords, size,
+				stats.MinOrder, stats.Order, stats.Tokenizer)
+			if len(top) > 0 {
+				c.Privmsgf(target, "Most common words: %s", strings.Join(top, ", "))
+			}
+		}()
+	case "why":
+		mdb, err := speakingCorpus(corpora, settings)
+		if err != nil {
+			c.Privmsgf(target, "Error: %s", err)
+			return
+		}
+		seed, steps, err := mdb.Explain(strings.Join(args[1:], " "))
+		if err != nil {
+			c.Privmsgf(target, "Error: %s", err)
+			return
+		}
+		explanation := []string{"seed: " + strings.Join(seed, " ")}
+		for _, step := range steps {
+			explanation = append(explanation, step.String())
+		}
+		c.Privmsg(target, strings.Join(explanation, " | "))
+	default:
+		c.Privmsgf(target, "Unknown markov command: %s", args[0])
+	}
+}
@@ -0,0 +1,364 @@
+package dulbecco
+
+import (
+	"fmt"
+	"github.com/piger/dulbecco/irclog"
+	"github.com/piger/dulbecco/markov"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Bot holds the IRC connections and the subsystems shared between them.
+type Bot struct {
+	config   *Configuration
+	configMu sync.RWMutex
+	corpora  *markov.Corpora
+	// the filter of the messages learned, rebuilt with the configuration
+	filter *irclog.Filter
+
+	// connections by server name
+	connections map[string]*Connection
+	mu          sync.Mutex
+	wg          sync.WaitGroup
+
+	scheduler *Scheduler
+
+	// in-process plugins by name
+	plugins map[string]Plugin
+
+	// serializes reloads
+	reloadMu sync.Mutex
+}
+
+func NewBot(config *Configuration, corpora *markov.Corpora) *Bot {
+	bot := &Bot{
+		config:      config,
+		corpora:     corpora,
+		filter:      config.Training.Filter(),
+		connections: make(map[string]*Connection),
+		plugins:     make(map[string]Plugin),
+	}
+	bot.scheduler = NewScheduler(bot, config.Jobs)
+	SetReplies(config.Replies)
+
+	return bot
+}
+
+func (b *Bot) Config() *Configuration {
+	b.configMu.RLock()
+	defer b.configMu.RUnlock()
+
+	return b.config
+}
+
+func (b *Bot) Scheduler() *Scheduler {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.scheduler
+}
+
+// Returns the default markov corpus.
+func (b *Bot) MarkovDB() *markov.MarkovDB {
+	if b.corpora == nil {
+		return nil
+	}
+	return b.corpora.Default()
+}
+
+// Returns the filter of the messages learned from the channels.
+func (b *Bot) TrainingFilter() *irclog.Filter {
+	b.configMu.RLock()
+	defer b.configMu.RUnlock()
+
+	return b.filter
+}
+
+// Returns all the markov corpora.
+func (b *Bot) Corpora() *markov.Corpora {
+	return b.corpora
+}
+
+// Returns the names of the modules enabled on at least one server; the
+// "hipchat" module is always enabled when a Hipchat address is configured.
+func (b *Bot) usedPlugins() []string {
+	used := make(map[string]bool)
+	var names []string
+	for _, server := range b.config.Servers {
+		for _, name := range server.GetModules() {
+			if !used[name] {
+				used[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if b.config.Hipchat.Address != "" && !used["hipchat"] {
+		names = append(names, "hipchat")
+	}
+	return names
+}
+
+// Initialize the used modules that are not running yet.
+func (b *Bot) initPlugins() {
+	for _, name := range b.usedPlugins() {
+		if _, ok := b.plugins[name]; ok {
+			continue
+		}
+		plugin, err := newPlugin(name)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if err := plugin.Init(b); err != nil {
+			log.Printf("Cannot initialize module %s: %s", name, err)
+			continue
+		}
+		b.plugins[name] = plugin
+	}
+}
+
+// Restart the running modules whose settings changed from old, if they are
+// still used; when one of them fails to start the old configuration is
+// restored, the changed modules are restarted with it and the error is
+// returned. Must be called with mu locked.
+func (b *Bot) restartPlugins(old *Configuration) error {
+	var changed []string
+	for _, name := range b.usedPlugins() {
+		if _, ok := b.plugins[name]; !ok {
+			continue
+		}
+		if !reflect.DeepEqual(old.moduleSettings(name), b.config.moduleSettings(name)) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	var err error
+	for _, name := range changed {
+		if err = b.restartPlugin(name); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	b.configMu.Lock()
+	b.config = old
+	b.filter = old.Training.Filter()
+	b.configMu.Unlock()
+	for _, name := range changed {
+		if err := b.restartPlugin(name); err != nil {
+			log.Print(err)
+		}
+	}
+	return err
+}
+
+// Stop a module and start a new instance with the current configuration;
+// the old instance must be stopped first, as they may share resources like
+// a listening address. Must be called with mu locked.
+func (b *Bot) restartPlugin(name string) error {
+	log.Print("Restarting module ", name)
+	if plugin, ok := b.plugins[name]; ok {
+		plugin.Shutdown()
+		delete(b.plugins, name)
+	}
+
+	plugin, err := newPlugin(name)
+	if err != nil {
+		return err
+	}
+	if err := plugin.Init(b); err != nil {
+		return fmt.Errorf("cannot initialize module %s: %s", name, err)
+	}
+	b.plugins[name] = plugin
+	return nil
+}
+
+// Shutdown the modules not enabled on any server.
+func (b *Bot) shutdownUnusedPlugins() {
+	used := make(map[string]bool)
+	for _, name := range b.usedPlugins() {
+		used[name] = true
+	}
+
+	for name, plugin := range b.plugins {
+		if !used[name] {
+			log.Print("Stopping module ", name)
+			plugin.Shutdown()
+			delete(b.plugins, name)
+		}
+	}
+}
+
+// Returns the initialized modules among names.
+func (b *Bot) getPlugins(names []string) []Plugin {
+	var plugins []Plugin
+	for _, name := range names {
+		if plugin, ok := b.plugins[name]; ok {
+			plugins = append(plugins, plugin)
+		}
+	}
+	return plugins
+}
+
+// Connect to all the configured servers and start the scheduler.
+func (b *Bot) Start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.initPlugins()
+
+	for _, server := range b.config.Servers {
+		b.startConnection(server)
+	}
+
+	b.scheduler.Start()
+}
+
+// Must be called with mu locked.
+func (b *Bot) startConnection(server ServerConfiguration) {
+	log.Print("Connecting to: ", server.Address)
+
+	conn := NewConnection(server, b)
+	b.connections[server.Name] = conn
+	b.wg.Add(1)
+	go func(conn *Connection) {
+		conn.MainLoop()
+		b.wg.Done()
+	}(conn)
+}
+
+// Read the configuration file again and apply the differences to the
+// running bot: servers are connected or disconnected, channels are joined or
+// parted and callbacks, replies, modules and jobs are rebuilt; modules whose
+// settings changed are restarted and connections to servers with unchanged
+// connection settings are kept.
+// On errors the current configuration is kept.
+func (b *Bot) Reload() error {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+
+	config, err := ReadConfig(b.Config().filename)
+	if err != nil {
+		return err
+	}
+	log.Print("Reloading configuration from ", config.filename)
+
+	// connections are updated after releasing the lock, because the
+	// callbacks they are running may need it.
+	updates := make(map[*Connection]ServerConfiguration)
+	var stopped, replaced []*Connection
+	var replacements []ServerConfiguration
+
+	b.configMu.Lock()
+	old := b.config
+	b.config = config
+	b.filter = config.Training.Filter()
+	b.configMu.Unlock()
+
+	b.mu.Lock()
+	if err := b.restartPlugins(old); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	SetReplies(config.Replies)
+	b.initPlugins()
+
+	b.scheduler.Stop()
+	b.scheduler = NewScheduler(b, config.Jobs)
+	b.scheduler.Start()
+
+	servers := make(map[string]bool)
+	for _, server := range config.Servers {
+		servers[server.Name] = true
+		conn, ok := b.connections[server.Name]
+		if !ok {
+			b.startConnection(server)
+		} else if conn.needsReconnect(server) {
+			log.Printf("Connection settings for %s changed: reconnecting", server.Name)
+			stopped = append(stopped, conn)
+			replaced = append(replaced, conn)
+			replacements = append(replacements, server)
+		} else {
+			updates[conn] = server
+		}
+	}
+	for name, conn := range b.connections {
+		if !servers[name] {
+			log.Print("Disconnecting from removed server ", name)
+			stopped = append(stopped, conn)
+			delete(b.connections, name)
+		}
+	}
+	// keep Wait() from returning before the replacements are started
+	b.wg.Add(len(replacements))
+	b.mu.Unlock()
+
+	for _, conn := range stopped {
+		conn.Shutdown()
+	}
+	// the old connection must quit first, or the server would refuse the
+	// nickname of the new one
+	for _, conn := range replaced {
+		<-conn.done
+	}
+	if len(replacements) > 0 {
+		b.mu.Lock()
+		for _, server := range replacements {
+			b.startConnection(server)
+			b.wg.Done()
+		}
+		b.mu.Unlock()
+	}
+	for conn, server := range updates {
+		conn.reload(server, config.Plugins)
+	}
+
+	b.mu.Lock()
+	b.shutdownUnusedPlugins()
+	b.mu.Unlock()
+
+	return nil
+}
+
+// Wait until all the connections are terminated, then stop the modules.
+func (b *Bot) Wait() {
+	b.wg.Wait()
+
+	for _, plugin := range b.plugins {
+		plugin.Shutdown()
+	}
+}
+
+// Disconnect from all the servers.
+func (b *Bot) Shutdown() {
+	b.Scheduler().Stop()
+
+	for _, conn := range b.Connections() {
+		conn.Shutdown()
+	}
+}
+
+// Returns the connection to the named server, or nil.
+func (b *Bot) Connection(name string) *Connection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.connections[name]
+}
+
+// Returns all the connections.
+func (b *Bot) Connections() []*Connection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var conns []*Connection
+	for _, conn := range b.connections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
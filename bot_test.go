@@ -0,0 +1,61 @@
+package dulbecco
+
+import (
+	"github.com/piger/dulbecco/markov"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestartPlugins(t *testing.T) {
+	filename := writeTempConfig(t, "config.toml", `
+[[server]]
+name = "local"
+address = "localhost:6667"
+nickname = "pinolo"
+username = "pinolo"
+realname = "Pinot di pinolo"
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpora, err := markov.NewCorpora(markov.NewMemoryStore(), markov.Options{Order: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBot(config, corpora)
+	b.initPlugins()
+	running := b.plugins["markov"]
+	if running == nil {
+		t.Fatal("markov module not started")
+	}
+
+	// unchanged settings keep the running module
+	old := *config
+	if err := b.restartPlugins(&old); err != nil {
+		t.Fatal(err)
+	}
+	if b.plugins["markov"] != running {
+		t.Errorf("markov module restarted with unchanged settings")
+	}
+
+	// changed settings restart it
+	old.Markov.Temperature = 2
+	if err := b.restartPlugins(&old); err != nil {
+		t.Fatal(err)
+	}
+	if b.plugins["markov"] == running {
+		t.Errorf("markov module not restarted with changed settings")
+	}
+
+	// a module failing to start restores the old configuration
+	b.corpora = nil
+	if err := b.restartPlugins(&old); err == nil {
+		t.Errorf("restartPlugins() should fail without a markov database")
+	}
+	if b.Config() != &old {
+		t.Errorf("old configuration not restored")
+	}
+}
@@ -1,15 +1,10 @@
 package dulbecco
 
 import (
-	"bytes"
 	"fmt"
 	"log"
-	"os"
-	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
@@ -26,19 +21,20 @@ func (c *Connection) AddCallback(name string, callback IRCCallback) {
 	c.events[name] = append(c.events[name], callback)
 }
 
-// Execute registered callbacks for message
+// Execute registered callbacks for message; they run without holding cbMu,
+// so that a slow plugin doesn't hold up a reload.
 func (c *Connection) RunCallbacks(message *Message) {
-	if _, ok := c.events[message.Cmd]; ok {
-		for _, callback := range c.events[message.Cmd] {
-			callback(message)
-		}
-	}
-
+	c.cbMu.RLock()
+	callbacks := c.events[message.Cmd]
 	// catch-all handlers
-	if _, ok := c.events["*"]; ok {
-		for _, callback := range c.events["*"] {
-			callback(message)
-		}
+	catchAll := c.events["*"]
+	c.cbMu.RUnlock()
+
+	for _, callback := range callbacks {
+		callback(message)
+	}
+	for _, callback := range catchAll {
+		callback(message)
 	}
 }
 
@@ -53,90 +49,35 @@ func (c *Connection) SetupCallbacks(plugins []PluginConfiguration) {
 	c.AddCallback("PONG", c.h_PONG)
 	c.AddCallback("CTCP", c.h_CTCP)
 	c.AddCallback("KICK", c.h_KICK)
+	for _, cmd := range []string{"366", "PART", "KICK"} {
+		c.AddCallback(cmd, c.h_joined)
+	}
+	c.AddCallback("PRIVMSG", c.h_admin)
+	for _, cmd := range []string{"001", "353", "MODE", "JOIN", "PART", "KICK", "NICK", "QUIT"} {
+		c.AddCallback(cmd, c.h_ops)
+	}
+	c.AddCallback("*", c.h_modules)
 
 	for _, plugin := range plugins {
 		c.addPluginCallback(plugin)
 	}
 }
 
-// Add a callback for a plugin.
-// We use a separate method because we need a "copy" of the "plugin" variable,
-// since it will be bound inside the closure.
-func (c *Connection) addPluginCallback(plugin PluginConfiguration) {
-	// this is the actual plugin callback
-	c.AddCallback("PRIVMSG", func(message *Message) {
-		// "trigger" contains a regular expression with optional capture groups
-		// command is a text/template that can contain captures from the trigger
-		// regexp.
-		re := regexp.MustCompile(plugin.Trigger)
-		arg1, err := message.Arg(1)
-		if err != nil {
-			return
-		}
-		match := re.FindStringSubmatch(arg1)
-		if match == nil {
-			return
-		}
-		captures := make(map[string]string)
-		for i, name := range re.SubexpNames() {
-			if i == 0 || name == "" {
-				continue
-			}
-			captures[name] = match[i]
-		}
-		cmdtpl, err := template.New("cmd").Parse(plugin.Command)
-		if err != nil {
-			log.Printf("Cannot parse template: %s\n", err)
-			return
-		}
-		var cmdbuf bytes.Buffer
-		if err := cmdtpl.Execute(&cmdbuf, captures); err != nil {
-			log.Print("Cannot execute template: ", err)
-			return
-		}
-		cmdline := cmdbuf.String()
-
-		log.Printf("Running plugin %s: %s", plugin.Name, cmdline)
-
-		cmds := strings.Fields(cmdline)
-		cmd := exec.Command(cmds[0], cmds[1:]...)
-		env := []string{
-			"IRC_NICKNAME=" + message.Nick,
-			"IRC_HOST=" + message.Host,
-			"IRC_IDENT=" + message.Ident,
-			"IRC_ARGS=" + strings.Join(message.Args, " "),
-			"IRC_COMMAND=" + message.Cmd,
-			"IRC_TIMESTAMP=" + message.Time.String(),
-			"IRC_RAW=" + message.Raw,
-		}
-		cmd.Env = append(os.Environ(), env...)
-
-		if out, err := cmd.Output(); err == nil {
-			lines := strings.Trim(string(out), "\n")
-			target := message.ReplyTarget()
-			for _, line := range strings.Split(lines, "\n") {
-				c.Privmsg(target, line)
-			}
-		} else {
-			log.Printf("Failed exec for plugin '%s': %s", plugin.Name, err)
-		}
-	})
-}
-
 // callbacks
 
 // The INIT pseudo-event is fired when the TCP connection to the IRC
 // server is established successfully.
 func (c *Connection) h_INIT(message *Message) {
-	if len(c.config.Password) > 0 {
-		c.Pass(c.config.Password)
+	config := c.Config()
+	if len(config.Password) > 0 {
+		c.Pass(config.Password)
 	}
 	c.Nick(c.nickname)
-	c.User(c.config.Username, c.config.Realname)
+	c.User(config.Username, config.Realname)
 }
 
 func (c *Connection) JoinChannels() {
-	for _, channel := range c.config.Channels {
+	for _, channel := range c.Config().Channels {
 		c.Join(channel)
 	}
 }
@@ -144,13 +85,38 @@ func (c *Connection) JoinChannels() {
 // 001 numeric means we are "really connected" to the server. In this callback
 // is safe to do things like joining channels or identifying with IRC services.
 func (c *Connection) h_001(message *Message) {
-	if c.config.Nickserv != "" {
+	c.setConnected(true)
+
+	if c.Config().Nickserv != "" {
 		c.LoginNickserv()
 	} else {
 		c.JoinChannels()
 	}
 }
 
+// Keep track of the channels we are in; the jobs missed while we were not in
+// a channel are run at the end of the NAMES reply following our JOIN.
+func (c *Connection) h_joined(message *Message) {
+	switch message.Cmd {
+	case "366":
+		// RPL_ENDOFNAMES: <nick> <channel> :End of /NAMES list.
+		channel, err := message.Arg(1)
+		if err != nil {
+			return
+		}
+		c.setJoined(channel, true)
+		c.runPending(channel)
+	case "PART", "KICK":
+		nick := message.Nick
+		if message.Cmd == "KICK" {
+			nick, _ = message.Arg(1)
+		}
+		if strings.EqualFold(nick, c.Nickname()) {
+			c.setJoined(message.Channel(), false)
+		}
+	}
+}
+
 // rejoin when kicked after 5 seconds
 func (c *Connection) h_KICK(message *Message) {
 	channame, err1 := message.Arg(0)
@@ -186,7 +152,7 @@ func (c *Connection) h_PING(message *Message) {
 }
 
 func (c *Connection) h_PONG(message *Message) {
-	if !c.config.Debug {
+	if !c.Config().Debug {
 		return
 	}
 
@@ -201,52 +167,38 @@ func (c *Connection) h_PONG(message *Message) {
 		return
 	}
 	delta := time.Duration(time.Now().UnixNano() - theirTime)
-	log.Printf("Lag for %s: %v", c.config.Name, delta)
+	log.Printf("Lag for %s: %v", c.Config().Name, delta)
 }
 
-// generic PRIVMSG callback handling QUIT command and dummy reply.
+// generic PRIVMSG callback handling QUIT command and NickServ replies.
 func (c *Connection) h_PRIVMSG(message *Message) {
-	// arg0 and arg1 will always be present in a PRIVMSG
-	arg0, _ := message.Arg(0)
+	// arg1 will always be present in a PRIVMSG
 	arg1, _ := message.Arg(1)
 	// and Arg() returns an empty string on error so we are safe anyway
 
-	if strings.HasPrefix(arg1, "!quit") &&
+	settings := c.Settings(message.Channel())
+
+	if strings.HasPrefix(arg1, settings.CommandPrefix+"quit") &&
 		message.Nick == "sand" {
 		// XXX we should find a smarter way to disable auto-reconnect
 		c.tryReconnect = false
 		c.Quit()
-		return
 	} else if message.Nick == NickservName && strings.Index(arg1, "accepted") != -1 {
 		c.JoinChannels()
-		return
-	} else if strings.HasPrefix(arg1, "!") {
-		// this is a command, let it be handled by plugins callbacks
-		return
-	} else if !strings.HasPrefix(arg1, c.nickname) {
-		// it's not a message directed to us, but we can still train markov from it
-		c.mdb.ReadSentence(arg1)
-		return
-	}
-
-	// strip our own nickname from the input text
-	renick := regexp.MustCompile(fmt.Sprintf("%s *[:,] *", c.nickname))
-	text := renick.ReplaceAllLiteralString(arg1, "")
-
-	// markov!
-	c.mdb.ReadSentence(text)
-	reply := c.mdb.Generate(text)
-
-	// do not bother answering if the answer is the same as the input phrase
-	if reply == text || len(reply) == 0 {
-		c.Privmsg(arg0, message.Nick+": "+GetRandomReply())
-		return
 	}
+}
 
-	if message.IsFromChannel() {
-		c.Privmsg(arg0, message.Nick+": "+reply)
-	} else {
-		c.Privmsg(message.Nick, reply)
+// Dispatch every message to the modules enabled for its channel.
+func (c *Connection) h_modules(message *Message) {
+	event := &Event{Conn: c, Message: message}
+	settings := c.Settings(message.Channel())
+	c.cbMu.RLock()
+	modules := c.modules
+	c.cbMu.RUnlock()
+	for _, module := range modules {
+		if settings.PluginEnabled(module.Name()) {
+			module.Handle(event)
+		}
 	}
 }
 
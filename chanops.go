@@ -0,0 +1,139 @@
+package dulbecco
+
+import (
+	"strings"
+	"sync"
+)
+
+// NAMES prefixes of the channel operators; "~" (owner) and "&" (admin) are
+// used by some networks for users with even more privileges.
+const opPrefixes = "~&@"
+
+// The channel modes granting operator privileges and, separately, all the
+// modes taking a parameter when set or unset.
+const (
+	opModes        = "qao"
+	modesWithParam = "qaohvbeIk"
+)
+
+// channelOps tracks the operators of the channels we are in, as seen in the
+// NAMES replies and the MODE changes.
+type channelOps struct {
+	mu sync.Mutex
+	// lowercase channel -> lowercase nickname -> true
+	ops map[string]map[string]bool
+}
+
+func (co *channelOps) reset() {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.ops = nil
+}
+
+func (co *channelOps) resetChannel(channel string) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	delete(co.ops, strings.ToLower(channel))
+}
+
+func (co *channelOps) set(channel, nick string, op bool) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	channel, nick = strings.ToLower(channel), strings.ToLower(nick)
+	if !op {
+		delete(co.ops[channel], nick)
+		return
+	}
+	if co.ops == nil {
+		co.ops = make(map[string]map[string]bool)
+	}
+	if co.ops[channel] == nil {
+		co.ops[channel] = make(map[string]bool)
+	}
+	co.ops[channel][nick] = true
+}
+
+// Remove nick from every channel, or rename it if newNick is not empty.
+func (co *channelOps) rename(nick, newNick string) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	nick, newNick = strings.ToLower(nick), strings.ToLower(newNick)
+	for _, ops := range co.ops {
+		if ops[nick] {
+			delete(ops, nick)
+			if newNick != "" {
+				ops[newNick] = true
+			}
+		}
+	}
+}
+
+func (co *channelOps) isOp(channel, nick string) bool {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.ops[strings.ToLower(channel)][strings.ToLower(nick)]
+}
+
+// Returns true if nick is an operator of channel.
+func (c *Connection) IsOp(channel, nick string) bool {
+	return c.ops.isOp(channel, nick)
+}
+
+// Keep track of the channel operators.
+func (c *Connection) h_ops(message *Message) {
+	switch message.Cmd {
+	case "001":
+		c.ops.reset()
+	case "353":
+		// RPL_NAMREPLY: <nick> <type> <channel> :[prefix]<nick> ...
+		if len(message.Args) < 4 {
+			return
+		}
+		channel := message.Args[2]
+		for _, name := range strings.Fields(message.Args[3]) {
+			nick := strings.TrimLeft(name, opPrefixes+"%+")
+			c.ops.set(channel, nick, strings.ContainsAny(name[:len(name)-len(nick)], opPrefixes))
+		}
+	case "MODE":
+		// MODE <channel> <modes> [<param> ...]
+		if len(message.Args) < 2 || !isChannelName(message.Args[0]) {
+			return
+		}
+		channel, params := message.Args[0], message.Args[2:]
+		adding := true
+		for _, mode := range message.Args[1] {
+			switch {
+			case mode == '+' || mode == '-':
+				adding = mode == '+'
+			case strings.ContainsRune(modesWithParam, mode) || (mode == 'l' && adding):
+				if len(params) == 0 {
+					return
+				}
+				if strings.ContainsRune(opModes, mode) {
+					c.ops.set(channel, params[0], adding)
+				}
+				params = params[1:]
+			}
+		}
+	case "JOIN":
+		// the NAMES reply follows our JOIN
+		if strings.EqualFold(message.Nick, c.Nickname()) {
+			c.ops.resetChannel(message.Channel())
+		}
+	case "PART", "KICK":
+		nick := message.Nick
+		if message.Cmd == "KICK" {
+			nick, _ = message.Arg(1)
+		}
+		if strings.EqualFold(nick, c.Nickname()) {
+			c.ops.resetChannel(message.Channel())
+		} else {
+			c.ops.set(message.Channel(), nick, false)
+		}
+	case "NICK":
+		newNick, _ := message.Arg(0)
+		c.ops.rename(message.Nick, newNick)
+	case "QUIT":
+		c.ops.rename(message.Nick, "")
+	}
+}
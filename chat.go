@@ -0,0 +1,240 @@
+package dulbecco
+
+import (
+	"errors"
+	"fmt"
+	"github.com/piger/dulbecco/irclog"
+	"github.com/piger/dulbecco/markov"
+	"log"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("markov", func() Plugin { return &markovPlugin{} })
+}
+
+// Default and maximum minutes of silence of !shutup.
+const (
+	shutupMinutes    = 30
+	maxShutupMinutes = 24 * 60
+)
+
+// The "markov" module learns from every message and replies with a markov
+// chain generated phrase when someone talks to the bot.
+type markovPlugin struct {
+	corpora *markov.Corpora
+	// the source of the random choices, besides the ones of the corpora
+	rand *rand.Rand
+	// the latest replies sent to each server and channel
+	recent recentMemory
+	// when the bot last spoke unprompted and until when it must be quiet,
+	// for each server and channel
+	chatter   map[string]*chatter
+	chatterMu sync.Mutex
+}
+
+type chatter struct {
+	lastReply time.Time
+	silenced  time.Time
+}
+
+func (p *markovPlugin) Name() string {
+	return "markov"
+}
+
+func (p *markovPlugin) Init(bot *Bot) error {
+	if bot.Corpora() == nil {
+		return errors.New("no markov database")
+	}
+	p.corpora = bot.Corpora()
+	p.rand = markov.NewRand(nil)
+	p.chatter = make(map[string]*chatter)
+	return nil
+}
+
+// Returns the key of the per channel state of the plugin.
+func channelKey(c *Connection, channel string) string {
+	return c.Config().Name + " " + strings.ToLower(channel)
+}
+
+// Returns the chatter state of a channel; chatterMu must be held.
+func (p *markovPlugin) chatterState(c *Connection, channel string) *chatter {
+	key := channelKey(c, channel)
+	state, ok := p.chatter[key]
+	if !ok {
+		state = &chatter{}
+		p.chatter[key] = state
+	}
+	return state
+}
+
+// Returns true if the bot was told to be quiet in channel at t.
+func (p *markovPlugin) silenced(c *Connection, channel string, t time.Time) bool {
+	if channel == "" {
+		return false
+	}
+	p.chatterMu.Lock()
+	defer p.chatterMu.Unlock()
+	return t.Before(p.chatterState(c, channel).silenced)
+}
+
+// Returns true if the bot can reply to a message not directed to it: the
+// message contains a trigger or, by chance, with ReplyProbability; never
+// during the quiet hours and the cooldown after the previous such reply.
+func (p *markovPlugin) chatty(c *Connection, settings *EffectiveSettings, message *Message, text string) bool {
+	if !settings.MarkovSpeak || !message.IsFromChannel() || settings.IsQuiet(message.Time) {
+		return false
+	}
+	p.chatterMu.Lock()
+	last := p.chatterState(c, message.Channel()).lastReply
+	p.chatterMu.Unlock()
+	if !last.IsZero() && message.Time.Sub(last) < settings.ReplyCooldown {
+		return false
+	}
+	return settings.IsTriggered(text) || p.rand.Float64() < settings.ReplyProbability
+}
+
+// !shutup [minutes]: channel operators and admins can keep the bot quiet in
+// a channel for a while; 0 minutes lets it speak again.
+func (p *markovPlugin) shutup(c *Connection, settings *EffectiveSettings, message *Message, args string) {
+	channel := message.Channel()
+	if !c.IsOp(channel, message.Nick) && c.permissionLevel(message) != PermissionAdmin {
+		log.Printf("Unauthorized shutup from %s in %s", message.GetFrom(), channel)
+		return
+	}
+	minutes := shutupMinutes
+	if args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 0 || n > maxShutupMinutes {
+			c.Privmsgf(channel, "usage: %sshutup [minutes, up to %d]", settings.CommandPrefix, maxShutupMinutes)
+			return
+		}
+		minutes = n
+	}
+
+	until := message.Time.Add(time.Duration(minutes) * time.Minute)
+	p.chatterMu.Lock()
+	p.chatterState(c, channel).silenced = until
+	p.chatterMu.Unlock()
+	if minutes == 0 {
+		c.Privmsg(channel, "I'm back")
+	} else {
+		c.Privmsgf(channel, "Ok, I'll be quiet until %s", until.Format("15:04"))
+	}
+}
+
+// Returns the corpus to speak from with the given settings: the configured
+// one, or a blend of several corpora.
+func speakingCorpus(corpora *markov.Corpora, settings *EffectiveSettings) (*markov.MarkovDB, error) {
+	if len(settings.MarkovBlend) > 0 {
+		return corpora.Blend(settings.MarkovBlend)
+	}
+	return corpora.Get(settings.MarkovCorpus)
+}
+
+// Generate a reply for target, different from the latest ones.
+func (p *markovPlugin) generate(c *Connection, settings *EffectiveSettings, target, text string) string {
+	mdb, err := speakingCorpus(p.corpora, settings)
+	if err != nil {
+		log.Print("markov: ", err)
+		return ""
+	}
+
+	key := channelKey(c, target)
+	reply := mdb.GenerateReply(text, p.recent.lines(key))
+	if reply == "" || reply == text || p.recent.repeats(key, reply) {
+		return ""
+	}
+	p.recent.add(key, reply, settings.RepeatWindow)
+	return reply
+}
+
+func (p *markovPlugin) Shutdown() {}
+
+func (p *markovPlugin) Handle(event *Event) {
+	message, c := event.Message, event.Conn
+	if message.Cmd != "PRIVMSG" || message.Nick == NickservName {
+		return
+	}
+
+	// arg1 will always be present in a PRIVMSG
+	arg1, _ := message.Arg(1)
+	target := message.ReplyTarget()
+	nickname := c.Nickname()
+	settings := c.Settings(message.Channel())
+	source := markov.Source{Nick: message.Nick, Channel: message.Channel()}
+	learn := func(text string) {
+		if !settings.MarkovLearn {
+			return
+		}
+		entry := irclog.Entry{Nick: message.Nick, Text: text}
+		if reason := c.bot.TrainingFilter().CheckFrom(message.GetFrom(), entry); reason != "" {
+			return
+		}
+		// our own replies, relayed by another bot
+		if p.recent.echoes(channelKey(c, target), text) {
+			return
+		}
+		mdb, err := p.corpora.Get(settings.MarkovCorpus)
+		if err != nil {
+			log.Print("markov: ", err)
+			return
+		}
+		mdb.Learn(text, source)
+	}
+
+	if settings.IsCommand(arg1) {
+		// this is a command, let it be handled by plugins callbacks
+		if name, args, ok := settings.ParseCommand(arg1); ok && strings.EqualFold(name, "shutup") && message.IsFromChannel() {
+			p.shutup(c, settings, message, args)
+		}
+		return
+	} else if !strings.HasPrefix(arg1, nickname) {
+		// it's not a message directed to us, but we can still train markov from it
+		learn(arg1)
+		// and sometimes say something anyway
+		if !p.silenced(c, message.Channel(), message.Time) && p.chatty(c, settings, message, arg1) {
+			if reply := p.generate(c, settings, target, arg1); reply != "" {
+				p.chatterMu.Lock()
+				p.chatterState(c, target).lastReply = message.Time
+				p.chatterMu.Unlock()
+				c.Privmsg(target, reply)
+			}
+		}
+		return
+	}
+
+	// strip our own nickname from the input text
+	renick := regexp.MustCompile(fmt.Sprintf("%s *[:,] *", regexp.QuoteMeta(nickname)))
+	text := renick.ReplaceAllLiteralString(arg1, "")
+
+	// markov!
+	learn(text)
+	if p.silenced(c, message.Channel(), message.Time) {
+		return
+	}
+	var reply string
+	if settings.MarkovSpeak {
+		reply = p.generate(c, settings, target, text)
+	}
+
+	// do not bother answering if the answer is the same as the input phrase
+	if reply == text || len(reply) == 0 {
+		key := channelKey(c, target)
+		reply = settings.RandomReply(p.rand, func(reply string) bool {
+			return p.recent.repeats(key, reply)
+		})
+		p.recent.add(key, reply, settings.RepeatWindow)
+	}
+
+	if message.IsFromChannel() {
+		c.Privmsg(target, message.Nick+": "+reply)
+	} else {
+		c.Privmsg(target, reply)
+	}
+}
@@ -0,0 +1,109 @@
+package dulbecco
+
+import (
+	"github.com/piger/dulbecco/markov"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarkovPlugin(t *testing.T) {
+	filename := writeTempConfig(t, "config.toml", `
+replies = [ "boh", "mah" ]
+
+[settings]
+reply_triggers = [ "pizza" ]
+reply_cooldown = "10m"
+
+[[server]]
+name = "local"
+address = "localhost:6667"
+nickname = "pinolo"
+username = "pinolo"
+realname = "Pinot di pinolo"
+channels = [ "#pizza" ]
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all the candidate replies are generated, however slow the test is
+	scoring := markov.DefaultScoring
+	scoring.Budget = time.Minute
+	corpora, err := markov.NewCorpora(markov.NewMemoryStore(), markov.Options{Order: 2, Scoring: scoring, Rand: rand.NewSource(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := NewBot(config, corpora)
+	c := NewConnection(config.Servers[0], bot)
+	p := &markovPlugin{}
+	if err := p.Init(bot); err != nil {
+		t.Fatal(err)
+	}
+	p.rand = rand.New(rand.NewSource(1))
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	say := func(minutes int, line string) []string {
+		message, err := parseMessage(":sand!sand@localhost PRIVMSG #pizza :" + line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message.Time = now.Add(time.Duration(minutes) * time.Minute)
+		p.Handle(&Event{Conn: c, Message: message})
+
+		var sent []string
+		for {
+			select {
+			case line := <-c.out:
+				sent = append(sent, strings.TrimSuffix(line, "\r\n"))
+			default:
+				return sent
+			}
+		}
+	}
+
+	for _, line := range []string{
+		"my dog is nice",
+		"my dog likes long walks in the park",
+		"the park is nice in the morning",
+		"I think the weather is nice today",
+	} {
+		if sent := say(0, line); sent != nil {
+			t.Fatalf("unprompted reply to %q: %q", line, sent)
+		}
+	}
+
+	// the canned replies are not repeated, the unprompted replies to the
+	// triggers are at least 10 minutes apart
+	var result [][]string
+	for _, message := range []struct {
+		minutes int
+		line    string
+	}{
+		{1, "pinolo: what about the weather?"},
+		{2, "pinolo: xyzzy"},
+		{3, "pinolo: xyzzy"},
+		{4, "a pizza in the park"},
+		{5, "another pizza"},
+		{14, "pizza is nice"},
+	} {
+		result = append(result, say(message.minutes, message.line))
+	}
+	golden := [][]string{
+		{"PRIVMSG #pizza :sand: I think the weather is nice today"},
+		{"PRIVMSG #pizza :sand: mah"},
+		{"PRIVMSG #pizza :sand: boh"},
+		{"PRIVMSG #pizza :a pizza in the morning"},
+		nil,
+		{"PRIVMSG #pizza :a pizza in the park is nice today"},
+	}
+	if !reflect.DeepEqual(result, golden) {
+		t.Errorf("sent %q, expected %q", result, golden)
+	}
+}
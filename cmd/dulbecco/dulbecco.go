@@ -2,86 +2,167 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/piger/dulbecco"
 	"github.com/piger/dulbecco/markov"
+	_ "github.com/piger/dulbecco/quotes"
 	"log"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 )
 
 var (
 	configFile = flag.String("config", "./config.json", "Path to the configuration file")
-	markovDb   = flag.String("mdb", "./markov-db", "Path to the directory containing the Markov DB")
-	importDb   = flag.Bool("import", false, "Enable import mode")
+	markovDb   = flag.String("mdb", "", "Path of the Markov DB (overrides the configuration)")
+	backend    = flag.String("backend", "", "Storage backend of the Markov DB (overrides the configuration)")
+	corpus     = flag.String("corpus", "", "Name of the corpus used by the train and markov commands (default: the default corpus)")
+	importDb   = flag.Bool("import", false, "Import the legacy format of utils/sputa.py from the standard input (see \"markov import\")")
 	importFile = flag.String("train", "", "Train with a IRC log file")
+	checkOnly  = flag.Bool("check-config", false, "Check the configuration file and exit")
+	dumpConfig = flag.Bool("dump-config", false, "Print the effective configuration and exit")
 )
 
-const markovOrder = 2
+// The commands that can be given after the options.
+var commands = map[string]func(args []string) error{
+	"markov": runMarkovCommand,
+	"train":  trainCommand,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] train [-format irssi|weechat|znc|hexchat|plain] <file>...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] markov <command> [arguments]\n\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "\nMarkov DB commands:")
+	printMarkovCommands()
+}
+
+// Open the markov corpus selected by -corpus in the database configured in
+// config, which can be nil, and in the command line flags.
+func openMarkovDB(config *dulbecco.Configuration) (*markov.MarkovDB, error) {
+	mc := markovConfig(config)
+	return markov.OpenCorpus(mc.GetBackend(), mc.GetPath(), *corpus, mc.Options())
+}
+
+// Like openMarkovDB, for the commands that only read an existing corpus.
+func lookupMarkovDB(config *dulbecco.Configuration) (*markov.MarkovDB, error) {
+	mc := markovConfig(config)
+	return markov.LookupCorpus(mc.GetBackend(), mc.GetPath(), *corpus, mc.Options())
+}
+
+// The markov settings of config (which may be nil), overridden by the command
+// line flags.
+func markovConfig(config *dulbecco.Configuration) dulbecco.MarkovConfiguration {
+	var mc dulbecco.MarkovConfiguration
+	if config != nil {
+		mc = config.Markov
+	}
+	if *backend != "" {
+		mc.Backend = *backend
+	}
+	if *markovDb != "" {
+		mc.Path = *markovDb
+	}
+	return mc
+}
+
+// Read the configuration file only if it exists, for the commands that can
+// work without it.
+func readOptionalConfig() *dulbecco.Configuration {
+	if _, err := os.Stat(*configFile); os.IsNotExist(err) {
+		return nil
+	}
+	config, err := dulbecco.ReadConfig(*configFile)
+	if err != nil {
+		log.Fatal("Error with configuration file: ", err)
+	}
+	return config
+}
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	if *importDb {
-		markov.ReadStdin(*markovDb, markovOrder)
+	if flag.NArg() > 0 {
+		command, ok := commands[flag.Arg(0)]
+		if !ok {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := command(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		return
-	} else if *importFile != "" {
-		if err := markov.ReadFile(*markovDb, *importFile, markovOrder); err != nil {
+	}
+
+	if *importDb || *importFile != "" {
+		mdb, err := openMarkovDB(readOptionalConfig())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *importDb {
+			markov.ReadStdin(mdb)
+		} else {
+			err = markov.ReadFile(mdb, *importFile)
+		}
+		mdb.Close()
+		if err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
 	config, err := dulbecco.ReadConfig(*configFile)
+	if *checkOnly {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", *configFile)
+		return
+	}
 	if err != nil {
 		log.Fatal("Error with configuration file: ", err)
 	}
+	if *dumpConfig {
+		if err := config.Dump(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	mdb, err := markov.NewMarkovDB(2, *markovDb)
+	mc := markovConfig(config)
+	corpora, err := markov.OpenCorpora(mc.GetBackend(), mc.GetPath(), mc.Options())
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer corpora.Close()
 
-	// start Hipchat handler
-	if config.Hipchat.Address != "" {
-		go func() {
-			if err := dulbecco.HipchatHandler(config.Hipchat.Address, mdb); err != nil {
-				log.Print("Hipchat handler error: ", err)
-			}
-		}()
-	}
-
-	var connections []*dulbecco.Connection
-	var wg sync.WaitGroup
-
-	for _, server := range config.Servers {
-		log.Print("Connecting to: ", server.Address)
-
-		wg.Add(1)
-		conn := dulbecco.NewConnection(server, config, mdb)
-		connections = append(connections, conn)
-		go func(conn *dulbecco.Connection) {
-			conn.MainLoop()
-			wg.Done()
-		}(conn)
-	}
+	bot := dulbecco.NewBot(config, corpora)
+	bot.Start()
 
 	cExit := make(chan bool)
 	go func() {
-		wg.Wait()
+		bot.Wait()
 		cExit <- true
 	}()
 
 	csig := make(chan os.Signal, 1)
-	signal.Notify(csig, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(csig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	for {
 		select {
 		case sig := <-csig:
 			log.Printf("%v received", sig)
-			for _, conn := range connections {
-				conn.Shutdown()
+			if sig == syscall.SIGHUP {
+				if err := bot.Reload(); err != nil {
+					log.Print("Configuration reload failed, keeping the old configuration: ", err)
+				}
+				continue
 			}
+			bot.Shutdown()
 			signal.Stop(csig)
 		case <-cExit:
 			return
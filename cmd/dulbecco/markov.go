@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/piger/dulbecco"
+	"github.com/piger/dulbecco/markov"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type markovCommand struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+// The "dulbecco markov <command>" commands.
+var markovCommands = map[string]markovCommand{
+	"corpora": {
+		"",
+		"list the corpora saved in the database",
+		markovCorpora,
+	},
+	"export": {
+		"[file]",
+		"write the corpus to file (default: standard output) in the portable format",
+		markovExport,
+	},
+	"forget": {
+		"<nick> [channel]",
+		"remove what nick said (in channel) from every corpus, or the one given with -corpus; needs markov.provenance",
+		markovForget,
+	},
+	"purge": {
+		"[regexp]...",
+		"remove the transitions matching the regular expressions (default: markov.blocklist) from every corpus, or the one given with -corpus",
+		markovPurge,
+	},
+	"stats": {
+		"[-top n]",
+		"print the size and the shape of the corpus, with its n most common words",
+		markovStats,
+	},
+	"why": {
+		"<text>",
+		"print the transitions that can generate text, i.e. a reply of the bot",
+		markovWhy,
+	},
+	"import": {
+		"<file>",
+		"merge an exported corpus into the database; \"-\" reads the standard input",
+		markovImport,
+	},
+	"migrate": {
+		"<backend>:<path> <backend>:<path>",
+		"copy the corpus from a database to a new one, e.g. leveldb:./markov-db bolt:./markov.db",
+		markovMigrate,
+	},
+}
+
+func printMarkovCommands() {
+	var names []string
+	for name := range markovCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := markovCommands[name]
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", name, cmd.usage, cmd.description)
+	}
+}
+
+func runMarkovCommand(args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := markovCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown markov command %q", args[0])
+	}
+	return cmd.run(args[1:])
+}
+
+// Split a "backend:path" database specification.
+func parseStoreSpec(spec string) (backend, path string, err error) {
+	fields := strings.SplitN(spec, ":", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return "", "", fmt.Errorf("invalid database %q, it must be <backend>:<path>", spec)
+	}
+	return fields[0], fields[1], nil
+}
+
+func markovMigrate(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: markov migrate <backend>:<path> <backend>:<path>")
+	}
+	srcBackend, srcPath, err := parseStoreSpec(args[0])
+	if err != nil {
+		return err
+	}
+	dstBackend, dstPath, err := parseStoreSpec(args[1])
+	if err != nil {
+		return err
+	}
+	if srcBackend == dstBackend && srcPath == dstPath {
+		return errors.New("source and destination are the same database")
+	}
+
+	src, err := markov.OpenStore(srcBackend, srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := markov.OpenStore(dstBackend, dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// refuse to mix two corpora
+	empty := true
+	err = dst.Iterate(nil, func(key, value []byte) error {
+		empty = false
+		return markov.ErrStopIteration
+	})
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("the destination database %s is not empty", args[1])
+	}
+
+	count, err := markov.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Copied %d keys from %s to %s\n", count, args[0], args[1])
+	return nil
+}
+
+func markovExport(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: markov export [file]")
+	}
+	mdb, err := lookupMarkovDB(readOptionalConfig())
+	if err != nil {
+		return err
+	}
+	defer mdb.Close()
+
+	w := os.Stdout
+	if len(args) == 1 && args[0] != "-" {
+		if w, err = os.Create(args[0]); err != nil {
+			return err
+		}
+	}
+	count, err := mdb.Export(w)
+	if w != os.Stdout {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d records\n", count)
+	return nil
+}
+
+func markovImport(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: markov import <file>")
+	}
+	r := os.Stdin
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	reader := bufio.NewReader(r)
+	header, err := markov.ReadExportHeader(reader)
+	if err != nil {
+		return fmt.Errorf("%s: %s", args[0], err)
+	}
+
+	// a new database is created with the settings of the export, an
+	// existing one must already have them
+	mc := markovConfig(readOptionalConfig())
+	opts := mc.Options()
+	opts.Order = header.Order
+	opts.MinOrder = header.MinOrder
+	opts.Tokenizer = header.Tokenizer
+	mdb, err := markov.OpenCorpus(mc.GetBackend(), mc.GetPath(), *corpus, opts)
+	if err != nil {
+		return err
+	}
+	defer mdb.Close()
+
+	count, err := mdb.Import(header, reader)
+	if err != nil {
+		return fmt.Errorf("%s: %s", args[0], err)
+	}
+	fmt.Printf("Imported %d records into %s\n", count, mc.GetPath())
+	return nil
+}
+
+func markovForget(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: markov forget <nick> [channel]")
+	}
+	var channel string
+	if len(args) == 2 {
+		channel = args[1]
+	}
+	return eachCorpus(readOptionalConfig(), func(name string, mdb *markov.MarkovDB) error {
+		count, err := mdb.Forget(args[0], channel)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: forgot %d transitions of %s\n", name, count, args[0])
+		return nil
+	})
+}
+
+func markovPurge(args []string) error {
+	config := readOptionalConfig()
+	patterns := args
+	if len(patterns) == 0 {
+		patterns = markovConfig(config).Blocklist
+	}
+	if len(patterns) == 0 {
+		return errors.New("usage: markov purge <regexp>... (or set markov.blocklist)")
+	}
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		res = append(res, re)
+	}
+
+	return eachCorpus(config, func(name string, mdb *markov.MarkovDB) error {
+		for _, re := range res {
+			count, err := mdb.Purge(re)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: purged %d transitions matching %s\n", name, count, re)
+		}
+		return nil
+	})
+}
+
+func markovStats(args []string) error {
+	fs := flag.NewFlagSet("markov stats", flag.ExitOnError)
+	top := fs.Int("top", 20, "Number of most common words to print")
+	fs.Parse(args)
+
+	mdb, err := lookupMarkovDB(readOptionalConfig())
+	if err != nil {
+		return err
+	}
+	defer mdb.Close()
+
+	stats, err := mdb.Stats(*top)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("order:         %d (min %d)\n", stats.Order, stats.MinOrder)
+	fmt.Printf("tokenizer:     %s\n", stats.Tokenizer)
+	fmt.Printf("states:        %d\n", stats.States)
+	fmt.Printf("transitions:   %d\n", stats.Transitions)
+	fmt.Printf("branching:     %.2f\n", stats.Branching)
+	fmt.Printf("words:         %d distinct, %d total\n", stats.Words, stats.TotalWords)
+	fmt.Printf("contributors:  %d\n", stats.Contributors)
+	if stats.Size >= 0 {
+		fmt.Printf("size:          %.1f MB\n", float64(stats.Size)/(1<<20))
+	}
+	if len(stats.TopWords) > 0 {
+		fmt.Println("most common words:")
+		for _, word := range stats.TopWords {
+			fmt.Printf("  %8d %s\n", word.Count, word.Word)
+		}
+	}
+	return nil
+}
+
+func markovWhy(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: markov why <text>")
+	}
+	mdb, err := lookupMarkovDB(readOptionalConfig())
+	if err != nil {
+		return err
+	}
+	defer mdb.Close()
+
+	seed, steps, err := mdb.Explain(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("seed: %s\n", strings.Join(seed, " "))
+	for _, step := range steps {
+		fmt.Println(step)
+	}
+	return nil
+}
+
+// Run fn on the corpus selected with -corpus, or on all of them.
+func eachCorpus(config *dulbecco.Configuration, fn func(name string, mdb *markov.MarkovDB) error) error {
+	mc := markovConfig(config)
+	corpora, err := markov.OpenCorpora(mc.GetBackend(), mc.GetPath(), mc.Options())
+	if err != nil {
+		return err
+	}
+	defer corpora.Close()
+
+	names := []string{*corpus}
+	if *corpus == "" {
+		if names, err = corpora.Names(); err != nil {
+			return err
+		}
+		names = append([]string{markov.DefaultCorpus}, names...)
+	}
+	for _, name := range names {
+		mdb, err := corpora.Lookup(name)
+		if err != nil {
+			return err
+		}
+		if err := fn(name, mdb); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func markovCorpora(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: markov corpora")
+	}
+	mc := markovConfig(readOptionalConfig())
+	corpora, err := markov.OpenCorpora(mc.GetBackend(), mc.GetPath(), mc.Options())
+	if err != nil {
+		return err
+	}
+	defer corpora.Close()
+
+	names, err := corpora.Names()
+	if err != nil {
+		return err
+	}
+	for _, name := range append([]string{markov.DefaultCorpus}, names...) {
+		fmt.Println(name)
+	}
+	return nil
+}
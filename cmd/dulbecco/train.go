@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/piger/dulbecco"
+	"github.com/piger/dulbecco/irclog"
+	"github.com/piger/dulbecco/markov"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lines given to a worker at once.
+const chunkLines = 1000
+
+type trainStats struct {
+	lines    int
+	messages int
+	learned  int
+	skipped  map[string]int
+}
+
+func newTrainStats() *trainStats {
+	return &trainStats{skipped: make(map[string]int)}
+}
+
+func (s *trainStats) add(other *trainStats) {
+	s.lines += other.lines
+	s.messages += other.messages
+	s.learned += other.learned
+	for reason, n := range other.skipped {
+		s.skipped[reason] += n
+	}
+}
+
+func (s *trainStats) print(w io.Writer) {
+	fmt.Fprintf(w, "%d lines, %d messages, %d learned\n", s.lines, s.messages, s.learned)
+	var reasons []string
+	for reason := range s.skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  skipped (%s): %d\n", reason, s.skipped[reason])
+	}
+}
+
+// The progress of an import: how many bytes of a file have been learned. It's
+// saved in the corpus, in the same batch as what was learned, so an
+// interrupted import can be resumed without learning anything twice.
+type fileProgress struct {
+	Offset int64
+	Done   bool
+}
+
+// Prefix of the metadata entries with the progress of each file.
+const progressMeta = "train:"
+
+// Returns the name of the metadata entry with the progress of filename.
+func progressName(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	return progressMeta + filename
+}
+
+func readProgress(mdb *markov.MarkovDB, name string) (*fileProgress, error) {
+	progress := &fileProgress{}
+	data, err := mdb.GetMeta(name)
+	if err != nil || data == "" {
+		return progress, err
+	}
+	if err := json.Unmarshal([]byte(data), progress); err != nil {
+		return nil, fmt.Errorf("progress of %s: %s", strings.TrimPrefix(name, progressMeta), err)
+	}
+	return progress, nil
+}
+
+// The nicknames used by the bot on every server.
+func botNicknames(config *dulbecco.Configuration) []string {
+	var nicks []string
+	for _, server := range config.Servers {
+		nicks = append(nicks, server.Nickname)
+		nicks = append(nicks, server.Altnicknames...)
+	}
+	return nicks
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+type trainer struct {
+	mdb        *markov.MarkovDB
+	bulk       *markov.BulkTrainer
+	parser     irclog.Parser
+	filter     *irclog.Filter
+	channel    string
+	workers    int
+	batchLines int
+	// ignore the saved progress
+	restart bool
+	stats   *trainStats
+	// set by SIGINT
+	interrupted int32
+}
+
+// dulbecco train [options] <file>...
+func trainCommand(args []string) error {
+	fs := flag.NewFlagSet("train", flag.ExitOnError)
+	format := fs.String("format", "plain", "Format of the logs: "+strings.Join(irclog.Formats(), ", "))
+	nicks := fs.String("nick", "", "Comma separated nicknames of the bot (default: the ones in the configuration)")
+	ignore := fs.String("ignore", "", "Comma separated nicknames to skip, besides training.ignore; the IRC wildcards * and ? are accepted")
+	skipBots := fs.Bool("skip-bots", true, "Skip services and nicknames that look like bots")
+	actions := fs.Bool("actions", false, "Learn actions (/me) too")
+	channel := fs.String("channel", "", "Channel the logs come from, recorded with the nicks when markov.provenance is enabled")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of parallel workers")
+	batchLines := fs.Int("batch", 100000, "Lines read between each write to the database")
+	restart := fs.Bool("restart", false, "Ignore the saved progress and read all the files again")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dulbecco [options] train [train options] <file>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *workers < 1 || *batchLines < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	parser, err := irclog.NewParser(*format)
+	if err != nil {
+		return err
+	}
+	config := readOptionalConfig()
+	// the filters of the configuration, and the options
+	filter := &irclog.Filter{}
+	if config != nil {
+		filter = config.Training.Filter()
+	}
+	filter.Self = splitList(*nicks)
+	filter.Ignore = append(filter.Ignore, splitList(*ignore)...)
+	filter.SkipBots = filter.SkipBots || *skipBots
+	filter.Actions = *actions
+	if filter.Self == nil && config != nil {
+		filter.Self = botNicknames(config)
+	}
+
+	mdb, err := openMarkovDB(config)
+	if err != nil {
+		return err
+	}
+	defer mdb.Close()
+
+	t := &trainer{
+		mdb:        mdb,
+		bulk:       mdb.NewBulkTrainer(),
+		parser:     parser,
+		filter:     filter,
+		channel:    *channel,
+		workers:    *workers,
+		batchLines: *batchLines,
+		restart:    *restart,
+		stats:      newTrainStats(),
+	}
+
+	// stop cleanly, after saving what has been learned so far
+	csig := make(chan os.Signal, 1)
+	signal.Notify(csig, os.Interrupt)
+	defer signal.Stop(csig)
+	go func() {
+		if _, ok := <-csig; ok {
+			log.Print("Interrupted, saving the progress")
+			atomic.StoreInt32(&t.interrupted, 1)
+		}
+	}()
+
+	start := time.Now()
+	for _, filename := range fs.Args() {
+		if err := t.trainFile(filename); err != nil {
+			return err
+		}
+		if atomic.LoadInt32(&t.interrupted) != 0 {
+			break
+		}
+	}
+
+	elapsed := time.Since(start)
+	t.stats.print(os.Stdout)
+	fmt.Printf("%d keys written in %s (%.0f lines/s)\n", t.bulk.Keys, elapsed.Round(time.Second),
+		float64(t.stats.lines)/elapsed.Seconds())
+	if atomic.LoadInt32(&t.interrupted) != 0 {
+		fmt.Println("The import was interrupted: run the same command again to resume it")
+	}
+	return nil
+}
+
+func (t *trainer) trainFile(filename string) error {
+	var r io.Reader = os.Stdin
+	// standard input can't be resumed
+	progress := &fileProgress{}
+	var meta string
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+
+		fi, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		meta = progressName(filename)
+		if !t.restart {
+			if progress, err = readProgress(t.mdb, meta); err != nil {
+				return err
+			}
+		}
+		switch {
+		case fi.Size() < progress.Offset:
+			log.Printf("%s: the file is shorter than the last time, reading it again", filename)
+			progress.Offset = 0
+		case progress.Done && fi.Size() == progress.Offset:
+			log.Printf("%s: already learned, skipping it", filename)
+			return nil
+		}
+		// logs still being written are read again from where they ended
+		if progress.Offset > 0 {
+			log.Printf("%s: resuming from byte %d", filename, progress.Offset)
+			if _, err := file.Seek(progress.Offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+
+	reader := bufio.NewReader(r)
+	lines := 0
+	for {
+		batch, size, err := readLines(reader, t.batchLines)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+		t.learn(batch)
+		progress.Offset += size
+		progress.Done = err == io.EOF
+		if meta != "" {
+			data, err := json.Marshal(progress)
+			if err != nil {
+				return err
+			}
+			t.bulk.SetMeta(meta, string(data))
+		}
+		if ferr := t.bulk.Flush(); ferr != nil {
+			return ferr
+		}
+		lines += len(batch)
+		if len(batch) > 0 {
+			log.Printf("%s: %d lines", filename, lines)
+		}
+
+		if err == io.EOF || atomic.LoadInt32(&t.interrupted) != 0 {
+			return nil
+		}
+	}
+}
+
+// Read up to n lines, returning them with their size in bytes; the error is
+// io.EOF at the end of the file. A last line without a newline is left out,
+// since the log may still be being written: it's read again when resuming.
+func readLines(reader *bufio.Reader, n int) ([]string, int64, error) {
+	var lines []string
+	var size int64
+	for len(lines) < n {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return lines, size, err
+		}
+		size += int64(len(line))
+		lines = append(lines, line)
+	}
+	return lines, size, nil
+}
+
+// Parse, filter and learn the lines with the workers.
+func (t *trainer) learn(lines []string) {
+	chunks := make(chan []string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < t.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats := newTrainStats()
+			for chunk := range chunks {
+				for _, line := range chunk {
+					stats.lines++
+					entry, ok := t.parser.Parse(line)
+					if !ok {
+						continue
+					}
+					stats.messages++
+					if reason := t.filter.Check(entry); reason != "" {
+						stats.skipped[reason]++
+						continue
+					}
+					if t.mdb.Blocked(entry.Text) {
+						stats.skipped["blocklist"]++
+						continue
+					}
+					t.bulk.Add(entry.Text, markov.Source{Nick: entry.Nick, Channel: t.channel})
+					stats.learned++
+				}
+			}
+			mu.Lock()
+			t.stats.add(stats)
+			mu.Unlock()
+		}()
+	}
+
+	for len(lines) > 0 {
+		n := chunkLines
+		if n > len(lines) {
+			n = len(lines)
+		}
+		chunks <- lines[:n]
+		lines = lines[n:]
+	}
+	close(chunks)
+	wg.Wait()
+}
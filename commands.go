@@ -115,7 +115,7 @@ func (c *Connection) Noticef(target, format string, a ...interface{}) {
 
 // ACTION command
 func (c *Connection) Action(target, message string) {
-	c.Privmsgf(target, "\001%s\001", message)
+	c.Privmsgf(target, "\001ACTION %s\001", message)
 }
 
 // INVITE command
@@ -178,5 +178,5 @@ func (c *Connection) CtcpReply(target, args string) {
 
 // IDENTIFY to NickServ
 func (c *Connection) LoginNickserv() {
-	c.Privmsgf(NickservName, "IDENTIFY %s", c.config.Nickserv)
+	c.Privmsgf(NickservName, "IDENTIFY %s", c.Config().Nickserv)
 }
@@ -2,21 +2,49 @@ package dulbecco
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/piger/dulbecco/irclog"
+	"github.com/piger/dulbecco/markov"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
-var defaultReplies []string
+var (
+	defaultReplies []string
+	// the latest reply of GetRandomReply, which is not repeated
+	lastReply string
+	repliesMu sync.Mutex
+
+	// the source of GetRandomReply
+	globalRand = markov.NewRand(nil)
+)
 
 type Configuration struct {
-	Servers []ServerConfiguration `toml:"server"`
-	Plugins []PluginConfiguration `toml:"plugin"`
-	Replies []string
-	Hipchat HipchatConfiguration
+	// values inherited by all the servers, see mergeDefaults()
+	Defaults ServerConfiguration
+	Servers  []ServerConfiguration `toml:"server"`
+	Plugins  []PluginConfiguration `toml:"plugin"`
+	Jobs     []JobConfiguration    `toml:"job"`
+	Replies  []string
+	Hipchat  HipchatConfiguration
+	Quotes   QuotesConfiguration
+	Markov   MarkovConfiguration
+	Training TrainingConfiguration
+	// global settings, see settings.go
+	Settings Settings
+
+	// the file the configuration was read from
+	filename string
+	// the fields (as in "server[0].password") resolved from secret
+	// references, masked by Dump
+	secrets map[string]bool
 }
 
 type ServerConfiguration struct {
@@ -33,6 +61,15 @@ type ServerConfiguration struct {
 	Password       string
 	Nickserv       string
 	Debug          bool
+	// hostmasks (nick!ident@host) allowed to use admin commands; IRC
+	// wildcards like "sand!*@*" are accepted and matched ignoring case.
+	Admins []string
+	// in-process plugins enabled on this server; see DefaultModules.
+	Modules []string
+	// settings overriding the global ones, for the whole server and for
+	// single channels.
+	Settings        Settings
+	ChannelSettings map[string]Settings `json:"channel" toml:"channel"`
 }
 
 func (sc *ServerConfiguration) GetHostname() string {
@@ -42,16 +79,224 @@ func (sc *ServerConfiguration) GetHostname() string {
 	return sc.Address
 }
 
+// Returns the names of the modules enabled on this server.
+func (sc *ServerConfiguration) GetModules() []string {
+	if sc.Modules == nil {
+		return DefaultModules
+	}
+	return sc.Modules
+}
+
+// Returns true if hostmask matches one of the configured admin masks; see
+// irclog.MatchMask.
+func (sc *ServerConfiguration) IsAdmin(hostmask string) bool {
+	for _, mask := range sc.Admins {
+		if irclog.MatchMask(mask, hostmask) {
+			return true
+		}
+	}
+	return false
+}
+
 type PluginConfiguration struct {
 	Name    string
 	Command string
 	Trigger string
+	// how the plugin output is interpreted: "text" (the default), where each
+	// line is sent as a PRIVMSG, "directives" or "json". See external.go.
+	Output string
+
+	// IRC events triggering the plugin: PRIVMSG (the default), ACTION,
+	// NOTICE, JOIN, PART, KICK, TOPIC, NICK, INVITE, numeric replies or TIMER.
+	// The trigger is matched against the text of the event (see Message.Text)
+	// and an empty trigger matches every event.
+	Events []string
+	// how often a TIMER plugin runs, i.e. "30m"
+	Interval string
+
+	// channel and server allow and deny lists; empty lists allow everything.
+	Channels        []string
+	ExcludeChannels []string `json:"exclude_channels" toml:"exclude_channels"`
+	Servers         []string
+	ExcludeServers  []string `json:"exclude_servers" toml:"exclude_servers"`
+	// "private" or "channel" restrict the plugin to private or channel
+	// events; empty means both.
+	Scope string
+}
+
+// A scheduled job, see scheduler.go.
+type JobConfiguration struct {
+	Name string
+	// a cron expression (i.e. "0 9 * * 1-5" or "@daily") or an interval
+	// (i.e. "90m"); only one of the two can be set.
+	Cron     string
+	Interval string
+	// a command line to run like a plugin, or a message to send; both are
+	// templates (see JobData).
+	Command string
+	Message string
+	// output mode for Command, like PluginConfiguration.Output
+	Output string
+	// servers and channels to send the output to; empty lists mean all the
+	// servers and all their configured channels.
+	Servers  []string
+	Channels []string
+	// what to do when the job fires while disconnected from a server: "skip"
+	// (the default) or "run" once in each channel after joining it again.
+	Missed string
+}
+
+// Filters of the messages learned from the channels and by "dulbecco train";
+// see irclog.Filter. The messages matching markov.blocklist are never
+// learned either.
+type TrainingConfiguration struct {
+	// skip the messages with fewer or more words, not counting URLs
+	MinWords int `json:"min_words" toml:"min_words"`
+	MaxWords int `json:"max_words" toml:"max_words"`
+	// skip the messages with a higher fraction (0-1) of characters which
+	// are not letters
+	MaxSymbols float64 `json:"max_symbols" toml:"max_symbols"`
+	// nicks and hostmasks to skip; the IRC wildcards * and ? are accepted
+	Ignore      []string
+	IgnoreHosts []string `json:"ignore_hosts" toml:"ignore_hosts"`
+	// skip services and nicks that look like bots
+	SkipBots bool `json:"skip_bots" toml:"skip_bots"`
+	// learn only the messages in these languages, when it can be guessed
+	Languages []string
+	// skip the messages identical to one of the latest dedup learned
+	Dedup int
+}
+
+// Returns a new filter of the messages to learn.
+func (tc *TrainingConfiguration) Filter() *irclog.Filter {
+	return &irclog.Filter{
+		Ignore:      tc.Ignore,
+		IgnoreHosts: tc.IgnoreHosts,
+		SkipBots:    tc.SkipBots,
+		MinWords:    tc.MinWords,
+		MaxWords:    tc.MaxWords,
+		MaxSymbols:  tc.MaxSymbols,
+		Languages:   tc.Languages,
+		Dedup:       tc.Dedup,
+	}
+}
+
+// Returns the settings of the named module, or nil for modules without
+// settings; a module is restarted on reload when they change.
+func (c *Configuration) moduleSettings(name string) interface{} {
+	switch name {
+	case "hipchat":
+		return c.Hipchat
+	case "quotes":
+		return c.Quotes
+	case "markov":
+		return c.Markov
+	}
+	return nil
 }
 
 type HipchatConfiguration struct {
 	Address string
 }
 
+// Settings for the "quotes" module.
+type QuotesConfiguration struct {
+	DbFile   string `json:"dbfile" toml:"dbfile"`
+	IndexDir string `json:"indexdir" toml:"indexdir"`
+}
+
+// Settings for the markov chains database.
+type MarkovConfiguration struct {
+	// storage backend: "leveldb" (the default), "bolt" (the default when
+	// built with the noleveldb tag) or "memory"
+	Backend string
+	// path of the database; a directory for leveldb, a file for bolt
+	Path string
+	// the length of the ngrams, 2 by default; with min_order > 0 the
+	// ngrams from min_order to order words are learned and generation backs
+	// off to shorter ones when a longer context is unknown. Both are saved in
+	// the database and can't be changed later.
+	Order    int
+	MinOrder int `json:"min_order" toml:"min_order"`
+	// values > 1 make rare words more likely, values < 1 favour the
+	// frequent ones; 1 (or 0) samples words by their frequency.
+	Temperature float64
+	// how messages are split in words: "unicode" (the default for new
+	// databases) or "fields"; it's saved in the database.
+	Tokenizer string
+	// words that replies should not be about, in addition to the common
+	// English and Italian ones
+	Stopwords []string
+	// the number of candidate replies generated within the time budget
+	// (i.e. "200ms"), and the weights used to choose the best one; see
+	// markov.Scoring.
+	Candidates     int
+	Budget         string
+	SurpriseWeight *float64 `json:"surprise_weight" toml:"surprise_weight"`
+	OverlapPenalty *float64 `json:"overlap_penalty" toml:"overlap_penalty"`
+	RepeatPenalty  *float64 `json:"repeat_penalty" toml:"repeat_penalty"`
+	// remember who said what, so that "!forget <nick>" can remove it; users
+	// are told apart by nick only, not by account or hostmask
+	Provenance bool
+	// regular expressions matching messages that must never be learned;
+	// "dulbecco markov purge" removes them from an existing corpus
+	Blocklist []string
+}
+
+const (
+	// Default path of the markov database.
+	DefaultMarkovPath = "./markov-db"
+	// Default length of the markov ngrams.
+	DefaultMarkovOrder = 2
+)
+
+func (mc *MarkovConfiguration) GetBackend() string {
+	if mc.Backend == "" {
+		return markov.DefaultBackend
+	}
+	return mc.Backend
+}
+
+func (mc *MarkovConfiguration) GetPath() string {
+	if mc.Path == "" {
+		return DefaultMarkovPath
+	}
+	return mc.Path
+}
+
+// Returns the options to open the markov database with.
+func (mc *MarkovConfiguration) Options() markov.Options {
+	opts := markov.Options{
+		Order:       mc.Order,
+		MinOrder:    mc.MinOrder,
+		Temperature: mc.Temperature,
+		Stopwords:   mc.Stopwords,
+		Scoring:     markov.DefaultScoring,
+		Tokenizer:   mc.Tokenizer,
+		Provenance:  mc.Provenance,
+		Blocklist:   mc.Blocklist,
+	}
+	if opts.Order == 0 {
+		opts.Order = DefaultMarkovOrder
+	}
+	if mc.Candidates > 0 {
+		opts.Scoring.Candidates = mc.Candidates
+	}
+	if d, err := time.ParseDuration(mc.Budget); err == nil && d > 0 {
+		opts.Scoring.Budget = d
+	}
+	if mc.SurpriseWeight != nil {
+		opts.Scoring.Surprise = *mc.SurpriseWeight
+	}
+	if mc.OverlapPenalty != nil {
+		opts.Scoring.Overlap = *mc.OverlapPenalty
+	}
+	if mc.RepeatPenalty != nil {
+		opts.Scoring.Repeat = *mc.RepeatPenalty
+	}
+	return opts
+}
+
 func ReadConfig(filename string) (*Configuration, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -65,26 +310,93 @@ func ReadConfig(filename string) (*Configuration, error) {
 		config, err = readTomlConfig(data)
 	}
 	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	config.filename = filename
+	if err := config.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	config.mergeDefaults()
+	if err := config.Validate(); err != nil {
 		return nil, err
 	}
 
-	if len(config.Servers) < 1 {
-		return nil, errors.New("no servers defined")
+	return config, nil
+}
+
+// Copy the fields set in Defaults to the servers that don't set them; since
+// there is no way to tell an unset boolean from a false one, booleans set to
+// true in Defaults can't be disabled by a server.
+func (config *Configuration) mergeDefaults() {
+	defaults := reflect.ValueOf(&config.Defaults).Elem()
+	for i := range config.Servers {
+		config.mergeValue(fmt.Sprintf("server[%d]", i), reflect.ValueOf(&config.Servers[i]).Elem(), "defaults", defaults)
+	}
+}
+
+func (config *Configuration) mergeValue(dstField string, dst reflect.Value, srcField string, src reflect.Value) {
+	if dst.Kind() == reflect.Struct {
+		t := dst.Type()
+		for i := 0; i < dst.NumField(); i++ {
+			if t.Field(i).PkgPath == "" {
+				name := configFieldName(t.Field(i))
+				config.mergeValue(joinField(dstField, name), dst.Field(i), joinField(srcField, name), src.Field(i))
+			}
+		}
+	} else if dst.IsZero() {
+		dst.Set(src)
+		config.inheritSecrets(dstField, srcField)
 	}
+}
 
-	defaultReplies = append(defaultReplies, config.Replies...)
+// Write the configuration to w in TOML format, with passwords and the values
+// resolved from secret references masked.
+func (config *Configuration) Dump(w io.Writer) error {
+	masked := config.maskValue("", reflect.ValueOf(config).Elem()).Interface().(Configuration)
+	maskSecrets(&masked.Defaults)
+	for i := range masked.Servers {
+		maskSecrets(&masked.Servers[i])
+	}
 
-	return config, nil
+	return toml.NewEncoder(w).Encode(&masked)
+}
+
+func maskSecrets(server *ServerConfiguration) {
+	for _, secret := range []*string{&server.Password, &server.Nickserv} {
+		if *secret != "" {
+			*secret = maskedSecret
+		}
+	}
 }
 
 func readJsonConfig(data []byte) (*Configuration, error) {
 	var config Configuration
 	if err := json.Unmarshal(data, &config); err != nil {
+		// encoding/json only reports the offset of syntax errors
+		if serr, ok := err.(*json.SyntaxError); ok {
+			line, col := offsetToPosition(data, serr.Offset)
+			return nil, fmt.Errorf("line %d, column %d: %s", line, col, err)
+		}
 		return nil, err
 	}
 	return &config, nil
 }
 
+// Convert a byte offset into a line and column position.
+func offsetToPosition(data []byte, offset int64) (line, col int) {
+	line, col = 1, 1
+	for i := int64(0); i < offset-1 && i < int64(len(data)); i++ {
+		if data[i] == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return
+}
+
 func readTomlConfig(data []byte) (*Configuration, error) {
 	var config Configuration
 	if _, err := toml.Decode(string(data), &config); err != nil {
@@ -93,9 +405,30 @@ func readTomlConfig(data []byte) (*Configuration, error) {
 	return &config, nil
 }
 
+// Replace the replies used by GetRandomReply.
+func SetReplies(replies []string) {
+	repliesMu.Lock()
+	defer repliesMu.Unlock()
+
+	defaultReplies = replies
+}
+
+// Returns one of the global replies, never the same twice in a row.
 func GetRandomReply() string {
-	if len(defaultReplies) > 0 {
-		return defaultReplies[rand.Intn(len(defaultReplies))]
+	return randomReply(globalRand, nil)
+}
+
+// Returns one of the global replies for which avoid returns false, if any,
+// and never the latest one returned.
+func randomReply(r *rand.Rand, avoid func(string) bool) string {
+	repliesMu.Lock()
+	defer repliesMu.Unlock()
+
+	if len(defaultReplies) == 0 {
+		return "DEMENZA MI COLSE"
 	}
-	return "DEMENZA MI COLSE"
+	lastReply = pickReply(r, defaultReplies, func(reply string) bool {
+		return (len(defaultReplies) > 1 && reply == lastReply) || (avoid != nil && avoid(reply))
+	})
+	return lastReply
 }
@@ -0,0 +1,311 @@
+package dulbecco
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTempConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "dulbecco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestValidate(t *testing.T) {
+	filename := writeTempConfig(t, "config.toml", `
+[[server]]
+name = "local"
+address = "localhost"
+username = "pinolo"
+realname = "Pinot di pinolo"
+channels = [ "pizza" ]
+
+[[server]]
+name = "local"
+address = "localhost:6667"
+nickname = "pinolo"
+username = "pinolo"
+realname = "Pinot di pinolo"
+
+[[plugin]]
+name = "broken"
+command = "./broken {{ .foo"
+trigger = "^!broken("
+
+[[job]]
+name = "soon"
+interval = "soon"
+message = "hello"
+
+[[job]]
+name = "never"
+cron = "61 * * * *"
+message = "hello"
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	_, err := ReadConfig(filename)
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+
+	expected := []string{
+		"server[0].address",
+		"server[0].nickname",
+		"server[0].channels[0]",
+		"server[1].name",
+		"plugin[0].command",
+		"plugin[0].trigger",
+		"job[0].interval",
+		"job[1].cron",
+	}
+	if len(verr) != len(expected) {
+		t.Fatalf("expected %d errors, got %d:\n%s", len(expected), len(verr), verr)
+	}
+	for i, field := range expected {
+		if verr[i].Field != field {
+			t.Errorf("error %d: expected field %s, got %s", i, field, verr[i].Field)
+		}
+		if verr[i].Filename != filename {
+			t.Errorf("error %d: expected filename %s, got %s", i, filename, verr[i].Filename)
+		}
+	}
+}
+
+func TestJsonSyntaxError(t *testing.T) {
+	filename := writeTempConfig(t, "config.json", "{\n  \"servers\": [\n    {\"name\": \"local\",}\n  ]\n}\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	_, err := ReadConfig(filename)
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("expected a syntax error on line 3, got %v", err)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	secret := writeTempConfig(t, "secret", "s3cr3t\n")
+	defer os.RemoveAll(filepath.Dir(secret))
+	os.Setenv("DULBECCO_TEST_NICK", "pinolo")
+	defer os.Unsetenv("DULBECCO_TEST_NICK")
+
+	filename := writeTempConfig(t, "config.toml", `
+replies = [ "costs $${DULBECCO_TEST_NICK}", "file::/etc/motd" ]
+
+[defaults]
+realname = "Pinot di ${DULBECCO_TEST_NICK}"
+
+[[server]]
+name = "local"
+address = "localhost:6667"
+nickname = "${DULBECCO_TEST_NICK}"
+username = "pinolo"
+password = "file:`+secret+`"
+nickserv = "${DULBECCO_TEST_MISSING}"
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	_, err := ReadConfig(filename)
+	verr, ok := err.(ValidationError)
+	if !ok || len(verr) != 1 || verr[0].Field != "server[0].nickserv" {
+		t.Fatalf("expected an error for server[0].nickserv, got %v", err)
+	}
+
+	os.Setenv("DULBECCO_TEST_MISSING", "found")
+	defer os.Unsetenv("DULBECCO_TEST_MISSING")
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := config.Servers[0]
+	if server.Nickname != "pinolo" || server.Realname != "Pinot di pinolo" ||
+		server.Password != "s3cr3t" || server.Nickserv != "found" {
+		t.Fatalf("secrets not resolved: %+v", server)
+	}
+	if replies := config.Replies; len(replies) != 2 || replies[0] != "costs ${DULBECCO_TEST_NICK}" || replies[1] != "file:/etc/motd" {
+		t.Fatalf("escaped references resolved: %q", replies)
+	}
+
+	var buf bytes.Buffer
+	if err := config.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"Pinot di pinolo", "s3cr3t", "found", `Nickname = "pinolo"`} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("%q not masked:\n%s", secret, buf.String())
+		}
+	}
+	// only the fields holding a reference are masked, not the same value
+	// elsewhere
+	if !strings.Contains(buf.String(), `Username = "pinolo"`) {
+		t.Errorf("username masked:\n%s", buf.String())
+	}
+	if config.Servers[0].Realname != "Pinot di pinolo" {
+		t.Errorf("Dump changed the configuration")
+	}
+}
+
+func TestResolveSettings(t *testing.T) {
+	filename := writeTempConfig(t, "config.toml", `
+replies = [ "global" ]
+
+[settings]
+reply_probability = 0.1
+
+[[server]]
+name = "local"
+address = "localhost:6667"
+nickname = "pinolo"
+username = "pinolo"
+realname = "Pinot di pinolo"
+channels = [ "#work", "#fun" ]
+
+[server.settings]
+command_prefix = "."
+
+[server.channel."#work"]
+markov_speak = false
+reply_probability = 0.0
+
+[server.channel."#fun"]
+replies = [ "fun" ]
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &config.Servers[0]
+
+	work := config.Resolve(server, "#WORK")
+	if work.MarkovSpeak || !work.MarkovLearn || work.ReplyProbability != 0 || work.CommandPrefix != "." {
+		t.Errorf("wrong settings for #work: %+v", work)
+	}
+	fun := config.Resolve(server, "#fun")
+	if !fun.MarkovSpeak || fun.ReplyProbability != 0.1 || fun.Replies[0] != "fun" {
+		t.Errorf("wrong settings for #fun: %+v", fun)
+	}
+	private := config.Resolve(server, "")
+	if private.Replies[0] != "global" || private.CommandPrefix != "." {
+		t.Errorf("wrong settings for private messages: %+v", private)
+	}
+}
+
+func TestChatterSettings(t *testing.T) {
+	filename := writeTempConfig(t, "config.toml", `
+[settings]
+reply_triggers = [ "pizza", "caffè" ]
+reply_cooldown = "10m"
+quiet_hours = "23:30-08:00"
+
+[[server]]
+name = "local"
+address = "localhost:6667"
+nickname = "pinolo"
+username = "pinolo"
+realname = "Pinot di pinolo"
+
+[server.channel."#work"]
+quiet_hours = "9:00-18:00"
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &config.Servers[0]
+	settings := config.Resolve(server, "#fun")
+	if settings.ReplyCooldown != 10*time.Minute {
+		t.Errorf("wrong cooldown: %v", settings.ReplyCooldown)
+	}
+
+	triggers := map[string]bool{
+		"Pizza!":           true,
+		"un caffè?":        true,
+		"pizzaiolo":        false,
+		"che pizza, basta": true,
+		"nothing":          false,
+	}
+	for text, expected := range triggers {
+		if settings.IsTriggered(text) != expected {
+			t.Errorf("IsTriggered(%q) should be %v", text, expected)
+		}
+	}
+
+	work := config.Resolve(server, "#work")
+	quiet := []struct {
+		clock     string
+		fun, work bool
+	}{
+		{"23:29", false, false},
+		{"23:30", true, false},
+		{"03:00", true, false},
+		{"08:00", false, false},
+		{"12:00", false, true},
+		{"18:00", false, false},
+	}
+	for _, q := range quiet {
+		now, _ := time.Parse("15:04", q.clock)
+		if settings.IsQuiet(now) != q.fun || work.IsQuiet(now) != q.work {
+			t.Errorf("wrong quiet hours at %s", q.clock)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	filename := writeTempConfig(t, "config.toml", `
+[defaults]
+nickname = "pinolo"
+username = "pinolo"
+realname = "Pinot di pinolo"
+channels = [ "#pizza" ]
+
+[[server]]
+name = "one"
+address = "localhost:6667"
+
+[[server]]
+name = "two"
+address = "localhost:6697"
+nickname = "pinolo2"
+password = "secret"
+channels = [ "#pasta" ]
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, two := config.Servers[0], config.Servers[1]
+	if one.Nickname != "pinolo" || one.Username != "pinolo" || one.Channels[0] != "#pizza" {
+		t.Errorf("defaults not inherited: %+v", one)
+	}
+	if two.Nickname != "pinolo2" || two.Realname != "Pinot di pinolo" || two.Channels[0] != "#pasta" {
+		t.Errorf("defaults not overridden: %+v", two)
+	}
+
+	var buf bytes.Buffer
+	if err := config.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("password not masked:\n%s", buf.String())
+	}
+	if config.Servers[1].Password != "secret" {
+		t.Errorf("Dump changed the configuration")
+	}
+}
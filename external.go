@@ -0,0 +1,420 @@
+package dulbecco
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Plugin output modes.
+const (
+	OutputText       = "text"
+	OutputDirectives = "directives"
+	OutputJSON       = "json"
+)
+
+// Permission levels passed to plugins.
+const (
+	PermissionUser  = "user"
+	PermissionAdmin = "admin"
+)
+
+// PluginEvent is the JSON document written on the standard input of an
+// external plugin.
+type PluginEvent struct {
+	Plugin      string            `json:"plugin"`
+	Nickname    string            `json:"nickname"`
+	Ident       string            `json:"ident"`
+	Host        string            `json:"host"`
+	Command     string            `json:"command"`
+	Args        []string          `json:"args"`
+	Raw         string            `json:"raw"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Channel     string            `json:"channel"`
+	Target      string            `json:"target"`
+	BotNickname string            `json:"bot_nickname"`
+	Server      string            `json:"server"`
+	Match       string            `json:"match"`
+	Captures    map[string]string `json:"captures"`
+	Permission  string            `json:"permission"`
+	Language    string            `json:"language"`
+}
+
+// Environment returns the IRC_* environment variables for the event.
+// Named captures are exported as IRC_CAPTURE_<NAME>.
+func (e *PluginEvent) Environment() []string {
+	env := []string{
+		"IRC_PLUGIN=" + e.Plugin,
+		"IRC_NICKNAME=" + e.Nickname,
+		"IRC_HOST=" + e.Host,
+		"IRC_IDENT=" + e.Ident,
+		"IRC_ARGS=" + strings.Join(e.Args, " "),
+		"IRC_COMMAND=" + e.Command,
+		"IRC_TIMESTAMP=" + e.Timestamp.String(),
+		"IRC_RAW=" + e.Raw,
+		"IRC_CHANNEL=" + e.Channel,
+		"IRC_TARGET=" + e.Target,
+		"IRC_BOT_NICKNAME=" + e.BotNickname,
+		"IRC_SERVER=" + e.Server,
+		"IRC_MATCH=" + e.Match,
+		"IRC_PERMISSION=" + e.Permission,
+		"IRC_LANGUAGE=" + e.Language,
+	}
+	for name, value := range e.Captures {
+		env = append(env, "IRC_CAPTURE_"+strings.ToUpper(name)+"="+value)
+	}
+	return env
+}
+
+// PluginReply is a single reply of a plugin using the "json" output mode.
+type PluginReply struct {
+	// "privmsg" (the default), "notice" or "action"
+	Type string `json:"type"`
+	// defaults to the channel or nickname the message came from
+	Target string `json:"target"`
+	Text   string `json:"text"`
+}
+
+// PluginOutput is the document a plugin using the "json" output mode must
+// print on its standard output, e.g.:
+//
+//	{"replies": [{"type": "notice", "text": "hello"}]}
+type PluginOutput struct {
+	Replies []PluginReply `json:"replies"`
+}
+
+// Returns the permission level of the sender of message.
+func (c *Connection) permissionLevel(message *Message) string {
+	if message.Nick == "" {
+		return PermissionUser
+	}
+	if config := c.Config(); config.IsAdmin(message.GetFrom()) {
+		return PermissionAdmin
+	}
+	return PermissionUser
+}
+
+// Plugin scopes.
+const (
+	ScopePrivate = "private"
+	ScopeChannel = "channel"
+)
+
+// The pseudo-event fired every PluginConfiguration.Interval for timer plugins.
+const TimerEvent = "TIMER"
+
+// A plugin configured to run periodically.
+type pluginTimer struct {
+	plugin   PluginConfiguration
+	interval time.Duration
+}
+
+// Returns the events of a plugin, defaulting to PRIVMSG.
+func (pc *PluginConfiguration) GetEvents() []string {
+	if len(pc.Events) == 0 {
+		return []string{"PRIVMSG"}
+	}
+	events := make([]string, len(pc.Events))
+	for i, event := range pc.Events {
+		events[i] = strings.ToUpper(event)
+	}
+	return events
+}
+
+// Returns true if the plugin is allowed to run on the named server.
+func (pc *PluginConfiguration) AllowServer(name string) bool {
+	return allowName(name, pc.Servers, pc.ExcludeServers)
+}
+
+// Returns true if the plugin is allowed to run for an event on channel, which
+// is empty for private messages and events not bound to a channel.
+func (pc *PluginConfiguration) AllowChannel(channel string) bool {
+	switch pc.Scope {
+	case ScopePrivate:
+		if channel != "" {
+			return false
+		}
+	case ScopeChannel:
+		if channel == "" {
+			return false
+		}
+	}
+	if channel == "" {
+		return true
+	}
+	return allowName(channel, pc.Channels, pc.ExcludeChannels)
+}
+
+// Check name against an allow list and a deny list (case-insensitive).
+func allowName(name string, allow, deny []string) bool {
+	if containsName(deny, name) {
+		return false
+	}
+	return len(allow) == 0 || containsName(allow, name)
+}
+
+// Returns true if names contains name (case-insensitive).
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the callbacks for a plugin, one for each configured event.
+// We use a separate method because we need a "copy" of the "plugin" variable,
+// since it will be bound inside the closure.
+func (c *Connection) addPluginCallback(plugin PluginConfiguration) {
+	if !plugin.AllowServer(c.config.Name) {
+		return
+	}
+
+	// "trigger" contains a regular expression with optional capture groups
+	// command is a text/template that can contain captures from the trigger
+	// regexp.
+	re, err := regexp.Compile(plugin.Trigger)
+	if err != nil {
+		log.Printf("Invalid trigger for plugin '%s': %s", plugin.Name, err)
+		return
+	}
+
+	for _, event := range plugin.GetEvents() {
+		if event == TimerEvent {
+			interval, err := time.ParseDuration(plugin.Interval)
+			if err != nil || interval <= 0 {
+				log.Printf("Invalid interval for plugin '%s': %q", plugin.Name, plugin.Interval)
+				continue
+			}
+			c.timers = append(c.timers, pluginTimer{plugin, interval})
+			continue
+		}
+
+		// this is the actual plugin callback
+		c.AddCallback(event, func(message *Message) {
+			// never react to our own actions
+			if strings.EqualFold(message.Nick, c.Nickname()) {
+				return
+			}
+			channel := message.Channel()
+			if !plugin.AllowChannel(channel) {
+				return
+			}
+			settings := c.Settings(channel)
+			if !settings.PluginEnabled(plugin.Name) {
+				return
+			}
+			match := re.FindStringSubmatch(message.Text())
+			if match == nil {
+				return
+			}
+			event := c.newPluginEvent(plugin, message, re, match)
+			event.Language = settings.Language
+			event.Channel = channel
+			if channel != "" {
+				event.Target = channel
+			}
+			c.execPlugin(plugin, event)
+		})
+	}
+}
+
+// Run a TIMER plugin once for each allowed channel.
+func (c *Connection) runTimer(plugin PluginConfiguration) {
+	channels := plugin.Channels
+	if len(channels) == 0 {
+		channels = c.Config().Channels
+	}
+	for _, channel := range channels {
+		settings := c.Settings(channel)
+		if !plugin.AllowChannel(channel) || !settings.PluginEnabled(plugin.Name) {
+			continue
+		}
+		message := &Message{Cmd: TimerEvent, Args: []string{channel}, Time: time.Now()}
+		event := c.newPluginEvent(plugin, message, nil, nil)
+		event.Language = settings.Language
+		event.Channel = channel
+		event.Target = channel
+		c.execPlugin(plugin, event)
+	}
+}
+
+func (c *Connection) newPluginEvent(plugin PluginConfiguration, message *Message, re *regexp.Regexp, match []string) *PluginEvent {
+	captures := make(map[string]string)
+	if re != nil {
+		for i, name := range re.SubexpNames() {
+			if i == 0 || name == "" {
+				continue
+			}
+			captures[name] = match[i]
+		}
+	}
+
+	event := &PluginEvent{
+		Plugin:      plugin.Name,
+		Nickname:    message.Nick,
+		Ident:       message.Ident,
+		Host:        message.Host,
+		Command:     message.Cmd,
+		Args:        message.Args,
+		Raw:         message.Raw,
+		Timestamp:   message.Time,
+		Target:      message.Nick,
+		BotNickname: c.nickname,
+		Server:      c.Config().Name,
+		Captures:    captures,
+		Permission:  c.permissionLevel(message),
+	}
+	if len(match) > 0 {
+		event.Match = match[0]
+	}
+	return event
+}
+
+// Expand the command template of a plugin and run it.
+func (c *Connection) execPlugin(plugin PluginConfiguration, event *PluginEvent) {
+	cmdtpl, err := template.New("cmd").Parse(plugin.Command)
+	if err != nil {
+		log.Printf("Cannot parse template: %s\n", err)
+		return
+	}
+	var cmdbuf bytes.Buffer
+	if err := cmdtpl.Execute(&cmdbuf, event.Captures); err != nil {
+		log.Print("Cannot execute template: ", err)
+		return
+	}
+
+	c.runPlugin(plugin, cmdbuf.String(), event)
+}
+
+// Execute the plugin command line, feeding the event to its standard input,
+// and send its output back to IRC.
+func (c *Connection) runPlugin(plugin PluginConfiguration, cmdline string, event *PluginEvent) {
+	log.Printf("Running plugin %s: %s", plugin.Name, cmdline)
+
+	cmds := strings.Fields(cmdline)
+	if len(cmds) == 0 {
+		log.Printf("Empty command line for plugin '%s'", plugin.Name)
+		return
+	}
+	cmd := exec.Command(cmds[0], cmds[1:]...)
+	cmd.Env = append(os.Environ(), event.Environment()...)
+
+	stdin, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Cannot encode event for plugin '%s': %s", plugin.Name, err)
+		return
+	}
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	out, err := cmd.Output()
+	if err != nil {
+		log.Printf("Failed exec for plugin '%s': %s", plugin.Name, err)
+		return
+	}
+
+	replies, err := parsePluginOutput(plugin.Output, event.Target, out)
+	if err != nil {
+		log.Printf("Invalid output from plugin '%s': %s", plugin.Name, err)
+		return
+	}
+	for _, reply := range replies {
+		c.sendPluginReply(reply)
+	}
+}
+
+func (c *Connection) sendPluginReply(reply PluginReply) {
+	if reply.Target == "" || reply.Text == "" {
+		return
+	}
+
+	switch strings.ToLower(reply.Type) {
+	case "notice":
+		c.Notice(reply.Target, reply.Text)
+	case "action":
+		c.Action(reply.Target, reply.Text)
+	default:
+		c.Privmsg(reply.Target, reply.Text)
+	}
+}
+
+// Convert the output of a plugin into a list of replies; target is the
+// default target for replies that don't specify one.
+func parsePluginOutput(mode, target string, out []byte) ([]PluginReply, error) {
+	var replies []PluginReply
+
+	switch mode {
+	case OutputJSON:
+		var output PluginOutput
+		if err := json.Unmarshal(out, &output); err != nil {
+			return nil, err
+		}
+		for _, reply := range output.Replies {
+			if reply.Target == "" {
+				reply.Target = target
+			}
+			replies = append(replies, reply)
+		}
+	case OutputDirectives:
+		for _, line := range splitOutputLines(out) {
+			replies = append(replies, parseDirective(target, line))
+		}
+	default:
+		for _, line := range splitOutputLines(out) {
+			replies = append(replies, PluginReply{Target: target, Text: line})
+		}
+	}
+
+	return replies, nil
+}
+
+func splitOutputLines(out []byte) []string {
+	lines := strings.Trim(string(out), "\n")
+	if lines == "" {
+		return nil
+	}
+	return strings.Split(lines, "\n")
+}
+
+// Parse a single output line, which can be prefixed by one of these
+// directives:
+//
+//	/me text             send "text" as an ACTION
+//	/notice text         send "text" as a NOTICE
+//	/msg target text     send "text" as a PRIVMSG to "target"
+//
+// Lines without a directive are sent as a PRIVMSG to target.
+func parseDirective(target, line string) PluginReply {
+	reply := PluginReply{Target: target, Text: line}
+
+	fields := strings.SplitN(line, " ", 2)
+	switch fields[0] {
+	case "/me":
+		reply.Type = "action"
+	case "/notice":
+		reply.Type = "notice"
+	case "/msg":
+		if len(fields) < 2 {
+			reply.Text = ""
+			return reply
+		}
+		fields = strings.SplitN(fields[1], " ", 2)
+		reply.Target = fields[0]
+	default:
+		return reply
+	}
+
+	if len(fields) > 1 {
+		reply.Text = fields[1]
+	} else {
+		reply.Text = ""
+	}
+	return reply
+}
@@ -0,0 +1,156 @@
+package dulbecco
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParsePluginOutput(t *testing.T) {
+	tests := []struct {
+		mode     string
+		out      string
+		expected []PluginReply
+		err      bool
+	}{
+		{OutputText, "", nil, false},
+		{OutputText, "hello\nworld\n", []PluginReply{
+			{Target: "#pizza", Text: "hello"},
+			{Target: "#pizza", Text: "world"},
+		}, false},
+		{"", "/me waves\n", []PluginReply{{Target: "#pizza", Text: "/me waves"}}, false},
+		{OutputDirectives, "/me waves\nhello\n/msg sand psst\n", []PluginReply{
+			{Type: "action", Target: "#pizza", Text: "waves"},
+			{Target: "#pizza", Text: "hello"},
+			{Target: "sand", Text: "psst"},
+		}, false},
+		{OutputJSON, `{"replies": [{"type": "notice", "text": "hi"}, {"target": "sand", "text": "psst"}]}`, []PluginReply{
+			{Type: "notice", Target: "#pizza", Text: "hi"},
+			{Target: "sand", Text: "psst"},
+		}, false},
+		{OutputJSON, `{"replies": []}`, nil, false},
+		{OutputJSON, "hello", nil, true},
+	}
+
+	for _, test := range tests {
+		replies, err := parsePluginOutput(test.mode, "#pizza", []byte(test.out))
+		if (err != nil) != test.err {
+			t.Errorf("parsePluginOutput(%q, %q) error = %v", test.mode, test.out, err)
+			continue
+		}
+		if !reflect.DeepEqual(replies, test.expected) {
+			t.Errorf("parsePluginOutput(%q, %q) = %+v, expected %+v", test.mode, test.out, replies, test.expected)
+		}
+	}
+}
+
+func TestParseDirective(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected PluginReply
+	}{
+		{"hello world", PluginReply{Target: "#pizza", Text: "hello world"}},
+		{"/me waves", PluginReply{Type: "action", Target: "#pizza", Text: "waves"}},
+		{"/me", PluginReply{Type: "action", Target: "#pizza"}},
+		{"/notice read this", PluginReply{Type: "notice", Target: "#pizza", Text: "read this"}},
+		{"/msg sand hello there", PluginReply{Target: "sand", Text: "hello there"}},
+		{"/msg sand", PluginReply{Target: "sand"}},
+		{"/msg", PluginReply{Target: "#pizza"}},
+		{"/unknown text", PluginReply{Target: "#pizza", Text: "/unknown text"}},
+		{" /me not a directive", PluginReply{Target: "#pizza", Text: " /me not a directive"}},
+	}
+
+	for _, test := range tests {
+		if reply := parseDirective("#pizza", test.line); reply != test.expected {
+			t.Errorf("parseDirective(%q) = %+v, expected %+v", test.line, reply, test.expected)
+		}
+	}
+}
+
+func TestPluginEventEnvironment(t *testing.T) {
+	event := &PluginEvent{
+		Plugin:      "weather",
+		Nickname:    "sand",
+		Ident:       "~sand",
+		Host:        "localhost",
+		Command:     "PRIVMSG",
+		Args:        []string{"#pizza", "!weather Rome"},
+		Raw:         ":sand!~sand@localhost PRIVMSG #pizza :!weather Rome",
+		Timestamp:   time.Date(2015, time.March, 4, 10, 30, 0, 0, time.UTC),
+		Channel:     "#pizza",
+		Target:      "#pizza",
+		BotNickname: "pinolo",
+		Server:      "local",
+		Match:       "!weather Rome",
+		Captures:    map[string]string{"city": "Rome", "Country": ""},
+		Permission:  PermissionAdmin,
+		Language:    "it",
+	}
+
+	env := event.Environment()
+	sort.Strings(env)
+	expected := []string{
+		"IRC_ARGS=#pizza !weather Rome",
+		"IRC_BOT_NICKNAME=pinolo",
+		"IRC_CAPTURE_CITY=Rome",
+		"IRC_CAPTURE_COUNTRY=",
+		"IRC_CHANNEL=#pizza",
+		"IRC_COMMAND=PRIVMSG",
+		"IRC_HOST=localhost",
+		"IRC_IDENT=~sand",
+		"IRC_LANGUAGE=it",
+		"IRC_MATCH=!weather Rome",
+		"IRC_NICKNAME=sand",
+		"IRC_PERMISSION=admin",
+		"IRC_PLUGIN=weather",
+		"IRC_RAW=:sand!~sand@localhost PRIVMSG #pizza :!weather Rome",
+		"IRC_SERVER=local",
+		"IRC_TARGET=#pizza",
+		"IRC_TIMESTAMP=2015-03-04 10:30:00 +0000 UTC",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Environment() = %q, expected %q", env, expected)
+	}
+}
+
+func TestPluginAllowChannel(t *testing.T) {
+	tests := []struct {
+		plugin   PluginConfiguration
+		channel  string
+		expected bool
+	}{
+		{PluginConfiguration{}, "#pizza", true},
+		{PluginConfiguration{}, "", true},
+		{PluginConfiguration{Channels: []string{"#Pizza"}}, "#pizza", true},
+		{PluginConfiguration{Channels: []string{"#pizza"}}, "#fun", false},
+		{PluginConfiguration{Channels: []string{"#pizza"}}, "", true},
+		{PluginConfiguration{ExcludeChannels: []string{"#fun"}}, "#FUN", false},
+		{PluginConfiguration{ExcludeChannels: []string{"#fun"}}, "#pizza", true},
+		{PluginConfiguration{Channels: []string{"#fun"}, ExcludeChannels: []string{"#fun"}}, "#fun", false},
+		{PluginConfiguration{Scope: ScopePrivate}, "#pizza", false},
+		{PluginConfiguration{Scope: ScopePrivate}, "", true},
+		{PluginConfiguration{Scope: ScopeChannel}, "", false},
+		{PluginConfiguration{Scope: ScopeChannel, ExcludeChannels: []string{"#fun"}}, "#fun", false},
+		{PluginConfiguration{Scope: ScopeChannel}, "#pizza", true},
+	}
+
+	for _, test := range tests {
+		if allowed := test.plugin.AllowChannel(test.channel); allowed != test.expected {
+			t.Errorf("%+v: AllowChannel(%q) = %v, expected %v", test.plugin, test.channel, allowed, test.expected)
+		}
+	}
+
+	plugin := PluginConfiguration{Servers: []string{"local", "work"}, ExcludeServers: []string{"work"}}
+	for server, expected := range map[string]bool{"LOCAL": true, "work": false, "freenode": false} {
+		if allowed := plugin.AllowServer(server); allowed != expected {
+			t.Errorf("AllowServer(%q) = %v, expected %v", server, allowed, expected)
+		}
+	}
+	if events := (&PluginConfiguration{Events: []string{"join", "Timer"}}).GetEvents(); !reflect.DeepEqual(events, []string{"JOIN", TimerEvent}) {
+		t.Errorf("GetEvents() = %q", events)
+	}
+	if events := (&PluginConfiguration{}).GetEvents(); !reflect.DeepEqual(events, []string{"PRIVMSG"}) {
+		t.Errorf("default GetEvents() = %q", events)
+	}
+}
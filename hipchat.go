@@ -2,6 +2,7 @@ package dulbecco
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/piger/dulbecco/markov"
@@ -180,8 +181,44 @@ func talkHandler(w http.ResponseWriter, r *vRequest) {
 	sendJSONResponse(w, resp)
 }
 
-// Main loop, must be called from a goroutine
-func HipchatHandler(address string, mdb *markov.MarkovDB) error {
+func init() {
+	RegisterPlugin("hipchat", func() Plugin { return &hipchatPlugin{} })
+}
+
+// The "hipchat" module serves the Hipchat integration webhooks; it doesn't
+// handle IRC events.
+type hipchatPlugin struct {
+	server *http.Server
+}
+
+func (p *hipchatPlugin) Name() string {
+	return "hipchat"
+}
+
+func (p *hipchatPlugin) Init(bot *Bot) error {
+	address := bot.Config().Hipchat.Address
+	if address == "" {
+		return errors.New("no Hipchat address configured")
+	}
+	p.server = newHipchatServer(address, bot.MarkovDB())
+
+	go func() {
+		if err := p.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Print("Hipchat handler error: ", err)
+		}
+	}()
+	return nil
+}
+
+func (p *hipchatPlugin) Handle(event *Event) {}
+
+func (p *hipchatPlugin) Shutdown() {
+	if err := p.server.Close(); err != nil {
+		log.Print("Error closing the Hipchat handler: ", err)
+	}
+}
+
+func newHipchatServer(address string, mdb *markov.MarkovDB) *http.Server {
 	ac := &AppContext{
 		MarkovDB: mdb,
 	}
@@ -189,6 +226,5 @@ func HipchatHandler(address string, mdb *markov.MarkovDB) error {
 	hr := r.PathPrefix("/hipchat/").Subrouter()
 	hr.Handle("/talk", WithRequest(ac, vHandlerFunc(talkHandler)))
 
-	http.Handle("/", r)
-	return http.ListenAndServe(address, nil)
+	return &http.Server{Addr: address, Handler: r}
 }
@@ -5,11 +5,11 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
-	"github.com/piger/dulbecco/markov"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,7 +21,7 @@ var (
 // the number of *Loop() methods on Connection; it's used for synchronization
 // and must be updated accordingly.
 const (
-	numLoops = 4
+	numLoops = 5
 
 	NickservName = "nickserv"
 
@@ -35,6 +35,7 @@ const (
 // A connection to the IRC server, also the main data structure of the IRC bot.
 type Connection struct {
 	config ServerConfiguration
+	bot    *Bot
 
 	// current nickname
 	nickname string
@@ -55,35 +56,74 @@ type Connection struct {
 	inerr  chan error
 	outerr chan bool
 	wg     sync.WaitGroup
+	// closed by Shutdown, to stop waiting for a reconnection
+	stop     chan bool
+	stopOnce sync.Once
+	// closed when MainLoop returns
+	done chan bool
 
-	// markov database
-	mdb *markov.MarkovDB
+	// enabled in-process plugins
+	modules []Plugin
 
 	// callbacks
 	events CallbackMap
+
+	// plugins run by timerLoop()
+	timers []pluginTimer
+	// signals timerLoop() that the timers changed after a reload
+	timersChanged chan bool
+
+	// protects config, modules, events and timers, which are replaced when
+	// the configuration is reloaded; it's only held to read or replace them,
+	// never while running callbacks, plugins or jobs.
+	cbMu sync.RWMutex
+
+	// the operators of the channels we are in
+	ops channelOps
+
+	// true after the server welcomed us (001)
+	connected bool
+	// the channels we are in, lowercase
+	joined map[string]bool
+	// jobs missed while not in a channel, by lowercase channel; they are run
+	// after joining it
+	pending map[string][]pendingRun
+	mu      sync.Mutex
+}
+
+// A job run queued while not in a channel.
+type pendingRun struct {
+	name string
+	run  func()
 }
 
-func NewConnection(config ServerConfiguration, botConfig *Configuration, mdb *markov.MarkovDB) *Connection {
+func NewConnection(config ServerConfiguration, bot *Bot) *Connection {
 	conn := &Connection{
 		config:          config,
+		bot:             bot,
 		nickname:        config.Nickname,
 		floodProtection: true,
 		lastSent:        time.Now(),
 		out:             make(chan string, 32),
 		inerr:           make(chan error, numLoops),
 		outerr:          make(chan bool, numLoops),
-		mdb:             mdb,
+		modules:         bot.getPlugins(config.GetModules()),
 		tryReconnect:    true,
 		events:          make(CallbackMap),
+		timersChanged:   make(chan bool, 1),
+		stop:            make(chan bool),
+		done:            make(chan bool),
 	}
 
 	// setup internal callbacks
-	conn.SetupCallbacks(botConfig.Plugins)
+	conn.SetupCallbacks(bot.config.Plugins)
 
 	return conn
 }
 
 func (c *Connection) MainLoop() {
+	defer close(c.done)
+
 	for {
 		if err := c.Connect(); err != nil {
 			log.Print("Connection error: ", err)
@@ -94,7 +134,11 @@ func (c *Connection) MainLoop() {
 
 		c.reinit()
 		log.Printf("Sleeping %v before attempting a reconnection", SleepBetweenReconnects)
-		time.Sleep(SleepBetweenReconnects)
+		select {
+		case <-time.After(SleepBetweenReconnects):
+		case <-c.stop:
+			return
+		}
 	}
 }
 
@@ -117,37 +161,41 @@ func readTLSCertificate(filename string) ([]byte, error) {
 
 // Connect to the server, launch all internal goroutines.
 func (c *Connection) Connect() (err error) {
-	if c.config.Ssl {
+	c.cbMu.RLock()
+	config := c.config
+	c.cbMu.RUnlock()
+
+	if config.Ssl {
 		tlsConfig := &tls.Config{
-			ServerName: c.config.GetHostname(),
+			ServerName: config.GetHostname(),
 		}
 
-		if c.config.SslInsecure {
-			log.Print("Using insecure TLS for ", c.config.Name)
+		if config.SslInsecure {
+			log.Print("Using insecure TLS for ", config.Name)
 			tlsConfig.InsecureSkipVerify = true
 		}
 
-		if c.config.SslCertificate != "" {
+		if config.SslCertificate != "" {
 			roots := x509.NewCertPool()
-			tlsCert, err := readTLSCertificate(c.config.SslCertificate)
+			tlsCert, err := readTLSCertificate(config.SslCertificate)
 			if err != nil {
-				log.Fatalf("Cannot read TLS certificate %s: %s", c.config.SslCertificate, err)
+				log.Fatalf("Cannot read TLS certificate %s: %s", config.SslCertificate, err)
 			}
 			if ok := roots.AppendCertsFromPEM(tlsCert); !ok {
-				log.Fatalf("Cannot use TLS certificate %s: %s", c.config.SslCertificate, err)
+				log.Fatalf("Cannot use TLS certificate %s: %s", config.SslCertificate, err)
 			}
 			tlsConfig.RootCAs = roots
 		}
 
-		c.sock, err = tls.Dial("tcp", c.config.Address, tlsConfig)
+		c.sock, err = tls.Dial("tcp", config.Address, tlsConfig)
 	} else {
-		c.sock, err = net.Dial("tcp", c.config.Address)
+		c.sock, err = net.Dial("tcp", config.Address)
 	}
 	if err != nil {
 		return
 	}
 
-	log.Print("Connected to: ", c.config.Name)
+	log.Print("Connected to: ", config.Name)
 	c.io = bufio.NewReadWriter(bufio.NewReader(c.sock), bufio.NewWriter(c.sock))
 
 	// remember to update numLoops if you add or remove loop methods!
@@ -156,14 +204,158 @@ func (c *Connection) Connect() (err error) {
 	go c.readLoop()
 	go c.pingLoop()
 	go c.errLoop()
+	go c.timerLoop()
 
 	c.RunCallbacks(&Message{Cmd: "INIT"})
 
 	c.wg.Wait()
+	c.setConnected(false)
 
 	return nil
 }
 
+// Apply a new configuration for this server: rebuild the callbacks, enable
+// or disable modules and join or part channels. Connection settings like the
+// address or the nickname are not changed: see needsReconnect().
+func (c *Connection) reload(config ServerConfiguration, plugins []PluginConfiguration) {
+	c.cbMu.Lock()
+	old := c.config
+	c.config = config
+	c.modules = c.bot.getPlugins(config.GetModules())
+	c.events = make(CallbackMap)
+	c.timers = nil
+	c.SetupCallbacks(plugins)
+	c.cbMu.Unlock()
+
+	select {
+	case c.timersChanged <- true:
+	default:
+	}
+
+	if !c.Connected() {
+		return
+	}
+	for _, channel := range config.Channels {
+		if !containsName(old.Channels, channel) {
+			c.Join(channel)
+		}
+	}
+	for _, channel := range old.Channels {
+		if !containsName(config.Channels, channel) {
+			c.Part(channel)
+		}
+	}
+}
+
+// Returns true if the connection must be restarted to apply config.
+func (c *Connection) needsReconnect(config ServerConfiguration) bool {
+	c.cbMu.RLock()
+	defer c.cbMu.RUnlock()
+
+	old := c.config
+	return old.Address != config.Address ||
+		old.Ssl != config.Ssl ||
+		old.SslInsecure != config.SslInsecure ||
+		old.SslCertificate != config.SslCertificate ||
+		old.Nickname != config.Nickname ||
+		old.Username != config.Username ||
+		old.Realname != config.Realname ||
+		old.Password != config.Password ||
+		old.Nickserv != config.Nickserv
+}
+
+// Returns our current nickname.
+func (c *Connection) Nickname() string {
+	return c.nickname
+}
+
+// Returns the configuration of this connection.
+func (c *Connection) Config() ServerConfiguration {
+	c.cbMu.RLock()
+	defer c.cbMu.RUnlock()
+
+	return c.config
+}
+
+// Returns true if we are registered with the server.
+func (c *Connection) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connected
+}
+
+func (c *Connection) setConnected(connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.connected = connected
+	if !connected {
+		c.joined = nil
+	}
+}
+
+// Record that we joined or left channel.
+func (c *Connection) setJoined(channel string, joined bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	channel = strings.ToLower(channel)
+	if !joined {
+		delete(c.joined, channel)
+		return
+	}
+	if c.joined == nil {
+		c.joined = make(map[string]bool)
+	}
+	c.joined[channel] = true
+}
+
+// Run f when we are in channel, or queue it until the next time we join it;
+// returns false if f was queued. Only the latest f queued with a name is
+// kept. Must not be called by callbacks.
+func (c *Connection) RunOrQueue(channel, name string, f func()) bool {
+	c.mu.Lock()
+	if !c.joined[strings.ToLower(channel)] {
+		c.queue(strings.ToLower(channel), name, f)
+		c.mu.Unlock()
+		return false
+	}
+	c.mu.Unlock()
+
+	f()
+	return true
+}
+
+// Queue f for channel under name, replacing the one already queued with
+// that name. Must be called with c.mu held.
+func (c *Connection) queue(channel, name string, f func()) {
+	pending := c.pending[channel]
+	for i := range pending {
+		if pending[i].name == name {
+			pending[i].run = f
+			return
+		}
+	}
+	if c.pending == nil {
+		c.pending = make(map[string][]pendingRun)
+	}
+	c.pending[channel] = append(pending, pendingRun{name, f})
+}
+
+// Run the functions queued for channel while we were not in it.
+func (c *Connection) runPending(channel string) {
+	channel = strings.ToLower(channel)
+	c.mu.Lock()
+	pending := c.pending[channel]
+	delete(c.pending, channel)
+	c.mu.Unlock()
+
+	for _, p := range pending {
+		p.run()
+	}
+}
+
 func (c *Connection) errLoop() {
 	defer c.wg.Done()
 
@@ -240,6 +432,59 @@ func (c *Connection) pingLoop() {
 	}
 }
 
+// Run TIMER plugins at their configured intervals.
+func (c *Connection) timerLoop() {
+	defer c.wg.Done()
+
+	for {
+		c.cbMu.RLock()
+		timers := c.timers
+		c.cbMu.RUnlock()
+
+		if !c.runTimers(timers) {
+			return
+		}
+	}
+}
+
+// Run timers until the connection is closed, returning false, or until the
+// timers are changed by a reload, returning true.
+func (c *Connection) runTimers(timers []pluginTimer) bool {
+	next := make([]time.Time, len(timers))
+	now := time.Now()
+	for i, timer := range timers {
+		next[i] = now.Add(timer.interval)
+	}
+
+	for {
+		// a nil channel blocks forever, which is fine when there are no timers
+		var wait <-chan time.Time
+		if len(next) > 0 {
+			earliest := next[0]
+			for _, t := range next[1:] {
+				if t.Before(earliest) {
+					earliest = t
+				}
+			}
+			wait = time.After(earliest.Sub(time.Now()))
+		}
+
+		select {
+		case now := <-wait:
+			for i, timer := range timers {
+				if !now.Before(next[i]) {
+					c.runTimer(timer.plugin)
+					next[i] = now.Add(timer.interval)
+				}
+			}
+		case <-c.timersChanged:
+			return true
+		case <-c.outerr:
+			return false
+		}
+	}
+}
+
 func (c *Connection) write(line string) error {
 	if !c.floodProtection {
 		if t := c.rateLimit(len(line)); t != 0 {
@@ -275,5 +520,6 @@ func (c *Connection) rateLimit(chars int) time.Duration {
 
 func (c *Connection) Shutdown() {
 	c.tryReconnect = false
+	c.stopOnce.Do(func() { close(c.stop) })
 	c.inerr <- errors.New("shutdown requested")
 }
@@ -0,0 +1,100 @@
+package dulbecco
+
+import (
+	"github.com/piger/dulbecco/markov"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestConnection(t *testing.T) *Connection {
+	filename := writeTempConfig(t, "config.toml", `
+[[server]]
+name = "local"
+address = "localhost:6667"
+nickname = "pinolo"
+username = "pinolo"
+realname = "Pinot di pinolo"
+channels = [ "#pizza", "#fun" ]
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpora, err := markov.NewCorpora(markov.NewMemoryStore(), markov.Options{Order: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewConnection(config.Servers[0], NewBot(config, corpora))
+}
+
+func TestNeedsReconnect(t *testing.T) {
+	c := newTestConnection(t)
+	tests := []struct {
+		change   func(*ServerConfiguration)
+		expected bool
+	}{
+		{func(sc *ServerConfiguration) {}, false},
+		{func(sc *ServerConfiguration) { sc.Channels = []string{"#work"} }, false},
+		{func(sc *ServerConfiguration) { sc.Modules = []string{} }, false},
+		{func(sc *ServerConfiguration) { sc.Admins = []string{"sand!*@*"} }, false},
+		{func(sc *ServerConfiguration) { sc.Address = "localhost:6697" }, true},
+		{func(sc *ServerConfiguration) { sc.Ssl = true }, true},
+		{func(sc *ServerConfiguration) { sc.SslInsecure = true }, true},
+		{func(sc *ServerConfiguration) { sc.SslCertificate = "ca.pem" }, true},
+		{func(sc *ServerConfiguration) { sc.Nickname = "pinolo2" }, true},
+		{func(sc *ServerConfiguration) { sc.Username = "pinolo2" }, true},
+		{func(sc *ServerConfiguration) { sc.Realname = "Pinot" }, true},
+		{func(sc *ServerConfiguration) { sc.Password = "secret" }, true},
+		{func(sc *ServerConfiguration) { sc.Nickserv = "secret" }, true},
+	}
+
+	for i, test := range tests {
+		config := c.config
+		test.change(&config)
+		if reconnect := c.needsReconnect(config); reconnect != test.expected {
+			t.Errorf("test %d: needsReconnect() = %v, expected %v", i, reconnect, test.expected)
+		}
+	}
+}
+
+func TestReloadChannels(t *testing.T) {
+	tests := []struct {
+		channels []string
+		expected []string
+	}{
+		{[]string{"#pizza", "#fun"}, nil},
+		{[]string{"#FUN", "#Pizza"}, nil},
+		{[]string{"#pizza", "#fun", "#work"}, []string{"JOIN #work\r\n"}},
+		{[]string{"#pizza"}, []string{"PART #fun\r\n"}},
+		{[]string{"#work"}, []string{"JOIN #work\r\n", "PART #pizza\r\n", "PART #fun\r\n"}},
+		{nil, []string{"PART #pizza\r\n", "PART #fun\r\n"}},
+	}
+
+	for _, test := range tests {
+		c := newTestConnection(t)
+		c.setConnected(true)
+		config := c.config
+		config.Channels = test.channels
+		c.reload(config, nil)
+
+		var sent []string
+		for len(c.out) > 0 {
+			sent = append(sent, <-c.out)
+		}
+		if !reflect.DeepEqual(sent, test.expected) {
+			t.Errorf("reload(%q) sent %q, expected %q", test.channels, sent, test.expected)
+		}
+	}
+
+	// nothing is sent while disconnected
+	c := newTestConnection(t)
+	config := c.config
+	config.Channels = []string{"#work"}
+	c.reload(config, nil)
+	if len(c.out) != 0 {
+		t.Errorf("reload() sent %d lines while disconnected", len(c.out))
+	}
+}
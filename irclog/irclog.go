@@ -0,0 +1,324 @@
+// Package irclog reads the messages of IRC logs written by the most common
+// clients, to train the markov chains with them.
+package irclog
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A message read from a log.
+type Entry struct {
+	Nick string
+	Text string
+	// true for CTCP ACTIONs ("/me")
+	Action bool
+}
+
+// A Parser extracts the messages from the lines of a log.
+type Parser interface {
+	// Parse returns false for the lines which are not messages: joins,
+	// parts, mode changes, day changes and so on.
+	Parse(line string) (Entry, bool)
+}
+
+// Characters prefixing the nicks of channel operators, voiced users and so
+// on.
+const nickModes = "~&@%+"
+
+// A nick as written in the logs, with an optional mode prefix.
+const reNick = `[` + nickModes + ` ]?([^\s<>]+)`
+
+// regexpParser parses the lines matching a regular expression for messages and
+// one for actions; both must capture the nick and the text.
+type regexpParser struct {
+	message *regexp.Regexp
+	action  *regexp.Regexp
+}
+
+func (p *regexpParser) Parse(line string) (Entry, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if m := p.message.FindStringSubmatch(line); m != nil {
+		return Entry{Nick: m[1], Text: m[2]}, true
+	}
+	if p.action != nil {
+		if m := p.action.FindStringSubmatch(line); m != nil {
+			return Entry{Nick: m[1], Text: m[2], Action: true}, true
+		}
+	}
+	return Entry{}, false
+}
+
+var parsers = map[string]Parser{
+	// 15:24 <@nick> hello world!
+	// 15:24  * nick waves
+	"irssi": &regexpParser{
+		regexp.MustCompile(`^\S+ <` + reNick + `> (.*)$`),
+		regexp.MustCompile(`^\S+\s+\* ` + reNick + ` (.*)$`),
+	},
+	// 2016-12-19 15:24:41	@nick	hello world!
+	// 2016-12-19 15:24:41	 *	nick waves
+	// (joins, parts and server messages have "-->", "<--" and "--" as nick)
+	"weechat": &regexpParser{
+		regexp.MustCompile(`^[^\t]+\t[` + nickModes + `]?([^\s<>*-][^\s<>]*)\t(.*)$`),
+		regexp.MustCompile(`^[^\t]+\t ?\*\t` + reNick + ` (.*)$`),
+	},
+	// [15:24:41] <nick> hello world!
+	// [15:24:41] * nick waves
+	"znc": &regexpParser{
+		regexp.MustCompile(`^\[[^\]]+\] <` + reNick + `> (.*)$`),
+		regexp.MustCompile(`^\[[^\]]+\] \* ` + reNick + ` (.*)$`),
+	},
+	// Dec 19 15:24:41 <nick>	hello world!
+	// Dec 19 15:24:41 *	nick waves
+	"hexchat": &regexpParser{
+		regexp.MustCompile(`^\w{3} \d{1,2} [\d:]+ <` + reNick + `>\t(.*)$`),
+		regexp.MustCompile(`^\w{3} \d{1,2} [\d:]+ \*\t` + reNick + ` (.*)$`),
+	},
+	// one message per line, optionally prefixed by "<nick> "
+	"plain": plainParser{},
+}
+
+var rePlainNick = regexp.MustCompile(`^<` + reNick + `>\s+(.*)$`)
+
+type plainParser struct{}
+
+func (plainParser) Parse(line string) (Entry, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if m := rePlainNick.FindStringSubmatch(line); m != nil {
+		return Entry{Nick: m[1], Text: m[2]}, true
+	}
+	return Entry{Text: line}, line != ""
+}
+
+// Returns the sorted names of the supported log formats.
+func Formats() []string {
+	var names []string
+	for name := range parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the parser of the named log format.
+func NewParser(format string) (Parser, error) {
+	parser, ok := parsers[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown log format %q (available: %s)", format, strings.Join(Formats(), ", "))
+	}
+	return parser, nil
+}
+
+// Services and common bots, skipped when Filter.SkipBots is set.
+var botNicks = []string{"*serv", "*bot", "*bot_", "*bot[0-9]", "chanserv", "nickserv", "global"}
+
+// Filter decides which messages are worth learning; the zero value only
+// skips empty messages and actions. A Filter can be used by several
+// goroutines at once.
+type Filter struct {
+	// the nicks of the bot itself, whose lines must not be learned again
+	Self []string
+	// nicks to skip; IRC wildcards like "*bot" are accepted
+	Ignore []string
+	// hostmasks ("nick!user@host") to skip, with IRC wildcards; logs don't
+	// have them, see CheckFrom
+	IgnoreHosts []string
+	// skip services and nicks that look like bots
+	SkipBots bool
+	// learn the text of actions too
+	Actions bool
+	// skip the messages with fewer or more words, not counting URLs; 0 means
+	// no limit
+	MinWords int
+	MaxWords int
+	// skip the messages where the fraction of characters which are not
+	// letters, not counting spaces and URLs, is higher; 0 means no limit
+	MaxSymbols float64
+	// skip the messages written in other languages, as guessed by
+	// DetectLanguage; the ones in an unknown language are learned
+	Languages []string
+	// skip the messages identical, ignoring case and spaces, to one of the
+	// latest Dedup messages learned
+	Dedup int
+
+	mu     sync.Mutex
+	seen   map[string]bool
+	recent []string
+	next   int
+}
+
+// The reasons a message is skipped, as returned by Filter.Check.
+const (
+	SkipSelf      = "self"
+	SkipIgnore    = "ignored"
+	SkipBot       = "bot"
+	SkipAction    = "action"
+	SkipEmpty     = "empty"
+	SkipShort     = "short"
+	SkipLong      = "long"
+	SkipSymbols   = "symbols"
+	SkipLanguage  = "language"
+	SkipDuplicate = "duplicate"
+)
+
+// Check returns "" if the entry should be learned, or the reason it should be
+// skipped; the entries to be learned are remembered for Dedup.
+func (f *Filter) Check(entry Entry) string {
+	return f.CheckFrom("", entry)
+}
+
+// CheckFrom is Check for a message sent by mask ("nick!user@host"), which
+// is matched against IgnoreHosts.
+func (f *Filter) CheckFrom(mask string, entry Entry) string {
+	if reason := f.checkSender(mask, entry); reason != "" {
+		return reason
+	}
+	if reason := f.checkText(entry.Text); reason != "" {
+		return reason
+	}
+	if f.Dedup > 0 && f.duplicate(entry.Text) {
+		return SkipDuplicate
+	}
+	return ""
+}
+
+func (f *Filter) checkSender(mask string, entry Entry) string {
+	nick := strings.ToLower(entry.Nick)
+	switch {
+	case strings.TrimSpace(entry.Text) == "":
+		return SkipEmpty
+	case entry.Action && !f.Actions:
+		return SkipAction
+	case mask != "" && matchNick(f.IgnoreHosts, mask):
+		return SkipIgnore
+	case nick == "":
+		return ""
+	case matchNick(f.Self, nick):
+		return SkipSelf
+	case matchNick(f.Ignore, nick):
+		return SkipIgnore
+	case f.SkipBots && matchNick(botNicks, nick):
+		return SkipBot
+	}
+	return ""
+}
+
+func (f *Filter) checkText(text string) string {
+	var words, letters, chars int
+	for _, word := range strings.Fields(text) {
+		if isURL(word) {
+			continue
+		}
+		words++
+		for _, r := range word {
+			chars++
+			if unicode.IsLetter(r) {
+				letters++
+			}
+		}
+	}
+	switch {
+	case f.MinWords > 0 && words < f.MinWords:
+		return SkipShort
+	case f.MaxWords > 0 && words > f.MaxWords:
+		return SkipLong
+	case f.MaxSymbols > 0 && chars > 0 && float64(chars-letters)/float64(chars) > f.MaxSymbols:
+		return SkipSymbols
+	case len(f.Languages) > 0:
+		if language := DetectLanguage(text); language != "" && !containsString(f.Languages, language) {
+			return SkipLanguage
+		}
+	}
+	return ""
+}
+
+// Returns true if text was seen among the latest Dedup messages, otherwise
+// remembers it.
+func (f *Filter) duplicate(text string) bool {
+	key := strings.ToLower(strings.Join(strings.Fields(text), " "))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seen[key] {
+		return true
+	}
+	if f.seen == nil {
+		f.seen = make(map[string]bool)
+	}
+	// the latest lines are kept in a ring buffer
+	if len(f.recent) < f.Dedup {
+		f.recent = append(f.recent, key)
+	} else {
+		delete(f.seen, f.recent[f.next])
+		f.recent[f.next] = key
+		f.next = (f.next + 1) % len(f.recent)
+	}
+	f.seen[key] = true
+	return false
+}
+
+func isURL(word string) bool {
+	return strings.Contains(word, "://") || strings.HasPrefix(strings.ToLower(word), "www.")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchMask reports whether s matches the IRC wildcard pattern, where "*"
+// matches any run of characters and "?" a single one, ignoring case as IRC
+// servers do (RFC 1459 casemapping).
+func MatchMask(pattern, s string) bool {
+	var p, i int
+	// where to resume after a mismatch: the last "*" and the text it matched
+	star, starMatch := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, starMatch = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || foldByte(pattern[p]) == foldByte(s[i])):
+			p++
+			i++
+		case star >= 0:
+			starMatch++
+			p, i = star+1, starMatch
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// RFC 1459 considers {}|~ the lowercase of []\^.
+func foldByte(b byte) byte {
+	switch {
+	case b >= 'A' && b <= 'Z':
+		return b + 'a' - 'A'
+	case b >= '[' && b <= '^':
+		return b + '{' - '['
+	}
+	return b
+}
+
+func matchNick(patterns []string, nick string) bool {
+	for _, pattern := range patterns {
+		if MatchMask(pattern, nick) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package irclog
+
+import (
+	"testing"
+)
+
+func TestParsers(t *testing.T) {
+	tests := []struct {
+		format string
+		line   string
+		entry  Entry
+		ok     bool
+	}{
+		{"irssi", "15:24 <@pinolo> hello world!", Entry{"pinolo", "hello world!", false}, true},
+		{"irssi", "15:24 < sand> ciao", Entry{"sand", "ciao", false}, true},
+		{"irssi", "15:24  * sand waves", Entry{"sand", "waves", true}, true},
+		{"irssi", "15:24 -!- sand [~sand@host] has joined #dulbecco", Entry{}, false},
+		{"irssi", "--- Day changed Mon Dec 19 2016", Entry{}, false},
+		{"weechat", "2016-12-19 15:24:41\t@sand\thello world!", Entry{"sand", "hello world!", false}, true},
+		{"weechat", "2016-12-19 15:24:41\t *\tsand waves", Entry{"sand", "waves", true}, true},
+		{"weechat", "2016-12-19 15:24:41\t-->\tsand (~sand@host) has joined #dulbecco", Entry{}, false},
+		{"weechat", "2016-12-19 15:24:41\t--\tMode #dulbecco [+o sand] by ChanServ", Entry{}, false},
+		{"znc", "[15:24:41] <sand> hello world!", Entry{"sand", "hello world!", false}, true},
+		{"znc", "[15:24:41] * sand waves", Entry{"sand", "waves", true}, true},
+		{"znc", "[15:24:41] *** Joins: sand (~sand@host)", Entry{}, false},
+		{"hexchat", "Dec 19 15:24:41 <sand>\thello world!", Entry{"sand", "hello world!", false}, true},
+		{"hexchat", "Dec 19 15:24:41 *\tsand waves", Entry{"sand", "waves", true}, true},
+		{"hexchat", "Dec 19 15:24:41 -->\tsand (~sand@host) has joined #dulbecco", Entry{}, false},
+		{"plain", "hello world!", Entry{"", "hello world!", false}, true},
+		{"plain", "<sand> hello world!", Entry{"sand", "hello world!", false}, true},
+		{"plain", "", Entry{}, false},
+	}
+
+	for _, test := range tests {
+		parser, err := NewParser(test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := parser.Parse(test.line)
+		if ok != test.ok || entry != test.entry {
+			t.Errorf("%s: Parse(%q) = %+v, %v; expected %+v, %v", test.format, test.line, entry, ok, test.entry, test.ok)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	filter := &Filter{Self: []string{"pinolo"}, Ignore: []string{"troll*"}, SkipBots: true}
+	tests := []struct {
+		entry  Entry
+		reason string
+	}{
+		{Entry{"sand", "hello", false}, ""},
+		{Entry{"Pinolo", "hello", false}, SkipSelf},
+		{Entry{"trollface", "hello", false}, SkipIgnore},
+		{Entry{"NickServ", "hello", false}, SkipBot},
+		{Entry{"sand", "waves", true}, SkipAction},
+		{Entry{"sand", " ", false}, SkipEmpty},
+	}
+	for _, test := range tests {
+		if reason := filter.Check(test.entry); reason != test.reason {
+			t.Errorf("Check(%+v) = %q, expected %q", test.entry, reason, test.reason)
+		}
+	}
+}
+
+func TestFilterText(t *testing.T) {
+	filter := &Filter{
+		IgnoreHosts: []string{"*!*@bots.example.org"},
+		MinWords:    2,
+		MaxWords:    10,
+		MaxSymbols:  0.3,
+		Languages:   []string{"it", "en"},
+		Dedup:       2,
+	}
+	tests := []struct {
+		mask   string
+		text   string
+		reason string
+	}{
+		{"sand!sand@localhost", "ciao a tutti", ""},
+		{"relay!relay@bots.example.org", "ciao ragazzi", SkipIgnore},
+		{"Relay!relay@BOTS.example.org", "ciao ragazze", SkipIgnore},
+		{"", "ciao", SkipShort},
+		{"", "https://example.org/a/very/long/link", SkipShort},
+		{"", "look https://example.org/a/very/long/link", SkipShort},
+		{"", "one two three four five six seven eight nine ten eleven", SkipLong},
+		{"", "^_^ :-) <3 lol", SkipSymbols},
+		{"", "ich bin nicht der Mann, und das ist es", SkipLanguage},
+		{"", "the weather is nice and it is sunny", ""},
+		{"", "Ciao  A tutti", SkipDuplicate},
+		{"", "one more line", ""},
+		// only the latest 2 lines are remembered
+		{"", "ciao a tutti", ""},
+	}
+	for _, test := range tests {
+		if reason := filter.CheckFrom(test.mask, Entry{Nick: "sand", Text: test.text}); reason != test.reason {
+			t.Errorf("CheckFrom(%q, %q) = %q, expected %q", test.mask, test.text, reason, test.reason)
+		}
+	}
+
+	languages := map[string]string{
+		"I think that the weather is nice": "en",
+		"che cosa hai fatto con il gatto?": "it",
+		"je ne sais pas ce que c'est":      "fr",
+		"ok":                               "",
+		"the pizza è buona":                "",
+	}
+	for text, language := range languages {
+		if detected := DetectLanguage(text); detected != language {
+			t.Errorf("DetectLanguage(%q) = %q, expected %q", text, detected, language)
+		}
+	}
+}
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		ok      bool
+	}{
+		{"*!*@example.org", "sand!~sand@example.org", true},
+		{"*!*@EXAMPLE.org", "sand!sand@example.ORG", true},
+		{"*@*/staff/*", "sand!sand@user/staff/sand", true},
+		{"sand!*@*", "sand!sand@a/b/c", true},
+		{"s?nd!*", "sand!sand@localhost", true},
+		{"s?nd!*", "snd!sand@localhost", false},
+		{"[sand]!*", "{SAND}!sand@localhost", true},
+		{"*!*@example.org", "sand!sand@example.org.evil", false},
+		{"*", "", true},
+		{"", "sand", false},
+	}
+	for _, test := range tests {
+		if ok := MatchMask(test.pattern, test.s); ok != test.ok {
+			t.Errorf("MatchMask(%q, %q) = %v, expected %v", test.pattern, test.s, ok, test.ok)
+		}
+	}
+}
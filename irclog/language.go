@@ -0,0 +1,79 @@
+package irclog
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The most common words of the languages recognized by DetectLanguage.
+var languageWords = map[string][]string{
+	"en": {"the", "and", "is", "are", "was", "you", "that", "it", "of", "to", "this", "with", "for",
+		"have", "not", "what", "but", "they", "be", "my", "your", "we", "he", "she", "i'm", "don't"},
+	"it": {"il", "lo", "gli", "che", "di", "è", "sono", "un", "una", "per", "con", "ma", "mi",
+		"ti", "si", "ho", "hai", "ha", "del", "della", "questo", "anche", "cosa", "come", "perché", "io"},
+	"es": {"el", "los", "las", "que", "es", "por", "con", "pero", "una", "muy", "está", "del",
+		"para", "yo", "tu", "mi", "lo", "sí", "como", "qué", "porque", "esto", "tiene", "son"},
+	"fr": {"le", "les", "des", "est", "et", "je", "tu", "il", "une", "pas", "que", "qui", "dans",
+		"pour", "avec", "mais", "sur", "ce", "c'est", "du", "au", "vous", "nous", "suis"},
+	"de": {"der", "die", "das", "und", "ist", "ich", "du", "nicht", "ein", "eine", "mit", "auf",
+		"für", "aber", "auch", "es", "sie", "wir", "den", "dem", "zu", "von", "was", "sind"},
+}
+
+// languageSets holds the words of languageWords as sets.
+var (
+	languageSets  = make(map[string]map[string]bool)
+	languageNames = Languages()
+)
+
+func init() {
+	for language, words := range languageWords {
+		languageSets[language] = make(map[string]bool)
+		for _, word := range words {
+			languageSets[language][word] = true
+		}
+	}
+}
+
+// Returns the languages recognized by DetectLanguage.
+func Languages() []string {
+	var names []string
+	for name := range languageWords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Minimum number of common words a message must contain for its language to
+// be guessed.
+const minLanguageWords = 2
+
+// Guess the language of text from the common words it contains; returns ""
+// if it's not clear, i.e. for short messages.
+func DetectLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+
+	var best string
+	var bestCount int
+	tie := false
+	for _, language := range languageNames {
+		var count int
+		for _, word := range words {
+			if languageSets[language][word] {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount, tie = language, count, false
+		} else if count == bestCount {
+			tie = true
+		}
+	}
+	if bestCount < minLanguageWords || tie {
+		return ""
+	}
+	return best
+}
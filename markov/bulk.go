@@ -0,0 +1,200 @@
+package markov
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The number of buffered keys after which the users of a BulkTrainer should
+// call Flush.
+const DefaultFlushSize = 100000
+
+// BulkTrainer learns large amounts of sentences much faster than
+// ReadSentence: the transitions and the words are counted in memory and then
+// merged into the store by Flush, in a single batch so that they are never
+// half written. Add can be called by many goroutines at once.
+type BulkTrainer struct {
+	mdb *MarkovDB
+
+	mu      sync.Mutex
+	follows map[string]Follows
+	words   map[string]int
+	// word counts by provenance key
+	sources   map[string]int
+	total     int
+	sentences int
+	// metadata written by the next Flush
+	meta map[string]string
+
+	// totals of the flushed data, for the summary
+	Sentences int
+	Keys      int
+}
+
+func (mdb *MarkovDB) NewBulkTrainer() *BulkTrainer {
+	t := &BulkTrainer{mdb: mdb}
+	t.reset()
+	return t
+}
+
+func (t *BulkTrainer) reset() {
+	t.follows = make(map[string]Follows)
+	t.words = make(map[string]int)
+	t.sources = make(map[string]int)
+	t.total = 0
+	t.sentences = 0
+	t.meta = make(map[string]string)
+}
+
+// Write the metadata entry name with the next Flush, in the same batch as the
+// sentences added so far; i.e. the progress of an import.
+func (t *BulkTrainer) SetMeta(name, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.meta[name] = value
+}
+
+// Add the sentence, written by source, to the buffer.
+func (t *BulkTrainer) Add(sentence string, source Source) {
+	mdb := t.mdb
+	if mdb.Blocked(sentence) {
+		return
+	}
+	words := mdb.Tokenizer.Tokenize(sentence)
+	if len(words) < mdb.MinOrder {
+		return
+	}
+	transitions := mdb.transitions(words)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tracked := mdb.tracks(source)
+	for _, tr := range transitions {
+		t.add(tr.key, tr.word)
+		if tracked {
+			t.add(provenanceKey(source, tr.key), tr.word)
+		}
+	}
+	for _, word := range words {
+		word = mdb.Tokenizer.Normalize(word)
+		t.words[word]++
+		if tracked {
+			t.sources[string(provenanceKey(source, wordKey(word)))]++
+		}
+	}
+	t.total += len(words)
+	t.sentences++
+}
+
+func (t *BulkTrainer) add(key []byte, word string) {
+	follows := t.follows[string(key)]
+	follows.Add(word, 1)
+	t.follows[string(key)] = follows
+}
+
+// Add the counts of a record of an export to the buffer.
+func (t *BulkTrainer) addRecord(record *exportRecord) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case record.Ngram != nil:
+		if len(record.Ngram) < t.mdb.MinOrder || len(record.Ngram) > t.mdb.Order {
+			return fmt.Errorf("ngram of %d words", len(record.Ngram))
+		}
+		prefix := forwardPrefix
+		if record.Reverse {
+			prefix = reversePrefix
+		}
+		key, err := makePrefixedKey(prefix, record.Ngram)
+		if err != nil {
+			return err
+		}
+		follows := t.follows[string(key)]
+		for _, follow := range record.Follows {
+			follows.Add(follow.Word, follow.Count)
+		}
+		t.follows[string(key)] = follows
+	case record.Word != "":
+		t.words[record.Word] += record.Count
+	default:
+		return errors.New("neither an ngram nor a word")
+	}
+	return nil
+}
+
+// Returns the number of keys waiting to be flushed.
+func (t *BulkTrainer) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.follows) + len(t.words) + len(t.sources)
+}
+
+// Merge the buffered counts with the ones in the store and empty the buffer.
+func (t *BulkTrainer) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	mdb := t.mdb
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	// sorted keys are written faster by most stores
+	var keys []string
+	for key := range t.follows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	batch := mdb.store.NewBatch()
+	for _, key := range keys {
+		data, err := mdb.store.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		follows, err := decodeFollows(data)
+		if err != nil {
+			return err
+		}
+		for _, follow := range t.follows[key] {
+			follows.Add(follow.Word, follow.Count)
+		}
+		if data, err = json.Marshal(follows); err != nil {
+			return err
+		}
+		batch.Put([]byte(key), data)
+	}
+
+	for word, n := range t.words {
+		count, err := mdb.readCount(wordKey(word))
+		if err != nil {
+			return err
+		}
+		batch.Put(wordKey(word), []byte(strconv.Itoa(count+n)))
+	}
+	for key, n := range t.sources {
+		count, err := mdb.readCount([]byte(key))
+		if err != nil {
+			return err
+		}
+		batch.Put([]byte(key), []byte(strconv.Itoa(count+n)))
+	}
+	total, err := mdb.readCount(metaKey(metaWords))
+	if err != nil {
+		return err
+	}
+	batch.Put(metaKey(metaWords), []byte(strconv.Itoa(total+t.total)))
+	for name, value := range t.meta {
+		batch.Put(metaKey(name), []byte(value))
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+
+	t.Sentences += t.sentences
+	t.Keys += len(keys) + len(t.words) + len(t.sources)
+	t.reset()
+	return nil
+}
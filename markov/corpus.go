@@ -0,0 +1,485 @@
+package markov
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Named corpora share the store of the default one: the keys of each corpus
+// are prefixed by "\x00corpus:<name>\x00", so every corpus has its own
+// ngrams, words, provenance and metadata.
+const corpusPrefix = "\x00corpus:"
+
+// the metadata entries of the default corpus listing the named ones
+const metaCorpus = "corpus:"
+
+// The name of the default corpus, which can also be called "".
+const DefaultCorpus = "default"
+
+func corpusKeyPrefix(name string) []byte {
+	return []byte(corpusPrefix + name + "\x00")
+}
+
+// Returns an error if name can't be used for a corpus.
+func ValidCorpusName(name string) error {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("invalid corpus name %q", name)
+	}
+	return nil
+}
+
+// prefixStore is the view of a named corpus: it adds prefix to every key.
+type prefixStore struct {
+	base   Store
+	prefix []byte
+	// close base along with the view
+	owned bool
+}
+
+func (s *prefixStore) key(key []byte) []byte {
+	return append(append([]byte(nil), s.prefix...), key...)
+}
+
+func (s *prefixStore) Get(key []byte) ([]byte, error) {
+	return s.base.Get(s.key(key))
+}
+
+func (s *prefixStore) Put(key, value []byte) error {
+	return s.base.Put(s.key(key), value)
+}
+
+func (s *prefixStore) Delete(key []byte) error {
+	return s.base.Delete(s.key(key))
+}
+
+func (s *prefixStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return s.IterateFrom(prefix, nil, fn)
+}
+
+func (s *prefixStore) IterateFrom(prefix, start []byte, fn func(key, value []byte) error) error {
+	n := len(s.prefix)
+	if start != nil {
+		start = s.key(start)
+	}
+	return s.base.IterateFrom(s.key(prefix), start, func(key, value []byte) error {
+		return fn(key[n:], value)
+	})
+}
+
+func (s *prefixStore) NewBatch() Batch {
+	return &prefixBatch{s.base.NewBatch(), s}
+}
+
+func (s *prefixStore) Close() error {
+	if s.owned {
+		return s.base.Close()
+	}
+	return nil
+}
+
+type prefixBatch struct {
+	Batch
+	store *prefixStore
+}
+
+func (b *prefixBatch) Put(key, value []byte) {
+	b.Batch.Put(b.store.key(key), value)
+}
+
+func (b *prefixBatch) Delete(key []byte) {
+	b.Batch.Delete(b.store.key(key))
+}
+
+// defaultStore is the view of the default corpus, which hides the keys of the
+// named ones.
+type defaultStore struct {
+	Store
+	owned bool
+}
+
+func (s *defaultStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return s.IterateFrom(prefix, nil, fn)
+}
+
+func (s *defaultStore) IterateFrom(prefix, start []byte, fn func(key, value []byte) error) error {
+	return s.Store.IterateFrom(prefix, start, func(key, value []byte) error {
+		if bytes.HasPrefix(key, []byte(corpusPrefix)) {
+			return nil
+		}
+		return fn(key, value)
+	})
+}
+
+func (s *defaultStore) Close() error {
+	if s.owned {
+		return s.Store.Close()
+	}
+	return nil
+}
+
+func (s *defaultStore) Size() (int64, error) {
+	if sizer, ok := s.Store.(Sizer); ok {
+		return sizer.Size()
+	}
+	return -1, nil
+}
+
+// Corpora holds the corpora saved in a store: the default one and the named
+// ones, which are created the first time they are used.
+type Corpora struct {
+	store Store
+	opts  Options
+
+	mu  sync.Mutex
+	dbs map[string]*MarkovDB
+}
+
+// Open the corpora saved in store with the given options; Close closes the
+// store.
+func NewCorpora(store Store, opts Options) (*Corpora, error) {
+	// the corpora share the source
+	opts.Rand = lockSource(opts.Rand)
+	c := &Corpora{store: store, opts: opts, dbs: make(map[string]*MarkovDB)}
+	mdb, err := NewMarkovDB(&defaultStore{Store: store}, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.dbs[""] = mdb
+	return c, nil
+}
+
+// Open the corpora found at path with the named store backend.
+func OpenCorpora(backend, path string, opts Options) (*Corpora, error) {
+	store, err := OpenStore(backend, path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewCorpora(store, opts)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Open only the named corpus ("" is the default one) found at path, creating
+// it if needed; closing it closes the store.
+func OpenCorpus(backend, path, name string, opts Options) (*MarkovDB, error) {
+	return openCorpus(backend, path, name, opts, (*Corpora).Get)
+}
+
+// LookupCorpus is OpenCorpus for an existing corpus; see Corpora.Lookup.
+func LookupCorpus(backend, path, name string, opts Options) (*MarkovDB, error) {
+	return openCorpus(backend, path, name, opts, (*Corpora).Lookup)
+}
+
+func openCorpus(backend, path, name string, opts Options, get func(*Corpora, string) (*MarkovDB, error)) (*MarkovDB, error) {
+	store, err := OpenStore(backend, path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewCorpora(store, opts)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	mdb, err := get(c, name)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	switch s := mdb.store.(type) {
+	case *prefixStore:
+		s.owned = true
+	case *defaultStore:
+		s.owned = true
+	}
+	return mdb, nil
+}
+
+// Returns the default corpus.
+func (c *Corpora) Default() *MarkovDB {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dbs[""]
+}
+
+// Returns the named corpus, or the default one if name is "" or "default",
+// creating it if needed. New corpora use the tokenizer of the default one, so
+// that they can be blended.
+func (c *Corpora) Get(name string) (*MarkovDB, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if name == DefaultCorpus {
+		name = ""
+	}
+	if mdb, ok := c.dbs[name]; ok {
+		return mdb, nil
+	}
+	if err := ValidCorpusName(name); err != nil {
+		return nil, err
+	}
+
+	root := c.dbs[""]
+	opts := c.opts
+	if opts.Tokenizer == "" {
+		tokenizer, err := root.GetMeta(metaTokenizer)
+		if err != nil {
+			return nil, err
+		}
+		opts.Tokenizer = tokenizer
+	}
+	mdb, err := NewMarkovDB(&prefixStore{base: c.store, prefix: corpusKeyPrefix(name)}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("corpus %s: %s", name, err)
+	}
+	if err := root.SetMeta(metaCorpus+name, "1"); err != nil {
+		return nil, err
+	}
+	c.dbs[name] = mdb
+	return mdb, nil
+}
+
+// Returns the named corpus, or the default one if name is "" or "default",
+// like Get; unlike Get, it returns an error for corpora never created.
+func (c *Corpora) Lookup(name string) (*MarkovDB, error) {
+	if name != "" && name != DefaultCorpus {
+		saved, err := c.Default().GetMeta(metaCorpus + name)
+		if err != nil {
+			return nil, err
+		}
+		if saved == "" {
+			return nil, fmt.Errorf("unknown corpus %q", name)
+		}
+	}
+	return c.Get(name)
+}
+
+// Returns the sorted names of the named corpora saved in the store.
+func (c *Corpora) Names() ([]string, error) {
+	var names []string
+	prefix := metaKey(metaCorpus)
+	err := c.Default().store.Iterate(prefix, func(key, value []byte) error {
+		names = append(names, string(key[len(prefix):]))
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// Returns every corpus saved in the store, the default one first.
+func (c *Corpora) All() ([]*MarkovDB, error) {
+	names, err := c.Names()
+	if err != nil {
+		return nil, err
+	}
+	result := []*MarkovDB{c.Default()}
+	for _, name := range names {
+		mdb, err := c.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, mdb)
+	}
+	return result, nil
+}
+
+func (c *Corpora) Close() error {
+	return c.store.Close()
+}
+
+// The counts of a blend are scaled so that every corpus contributes about
+// this many occurrences, times its weight, to each ngram.
+const blendScale = 1000
+
+// Returns a read only MarkovDB generating text from the given corpora: the
+// words following an ngram are chosen with the probability they have in each
+// corpus, weighted by weights; the corpora must have the same order and
+// tokenizer. The other settings are the ones of the first corpus.
+func (c *Corpora) Blend(weights map[string]float64) (*MarkovDB, error) {
+	var names []string
+	for name, weight := range weights {
+		if weight > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no corpora to blend")
+	}
+	sort.Strings(names)
+
+	store := &blendStore{}
+	var first *MarkovDB
+	var firstTokenizer string
+	for _, name := range names {
+		mdb, err := c.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		tokenizer, err := mdb.GetMeta(metaTokenizer)
+		if err != nil {
+			return nil, err
+		}
+		if first == nil {
+			first, firstTokenizer = mdb, tokenizer
+		} else if mdb.Order != first.Order || mdb.MinOrder != first.MinOrder || tokenizer != firstTokenizer {
+			return nil, fmt.Errorf("corpus %q can't be blended with %q: different order or tokenizer", name, names[0])
+		}
+		store.stores = append(store.stores, mdb.store)
+		store.weights = append(store.weights, weights[name])
+	}
+	if len(names) == 1 {
+		return first, nil
+	}
+
+	return &MarkovDB{
+		Order:       first.Order,
+		MinOrder:    first.MinOrder,
+		Temperature: first.Temperature,
+		Scoring:     first.Scoring,
+		Tokenizer:   first.Tokenizer,
+		store:       store,
+		stopwords:   first.stopwords,
+		rand:        first.rand,
+	}, nil
+}
+
+// blendStore reads several stores as if they were one, see Corpora.Blend.
+type blendStore struct {
+	stores  []Store
+	weights []float64
+}
+
+var errReadOnly = errors.New("markov: blended corpora are read only")
+
+func (s *blendStore) Get(key []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(key, []byte(wordPrefix)) || bytes.Equal(key, metaKey(metaWords)):
+		// word counts are summed
+		var total int
+		for _, store := range s.stores {
+			data, err := store.Get(key)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > 0 {
+				n, err := strconv.Atoi(string(data))
+				if err != nil {
+					return nil, err
+				}
+				total += n
+			}
+		}
+		if total == 0 {
+			return nil, nil
+		}
+		return []byte(strconv.Itoa(total)), nil
+	case bytes.HasPrefix(key, []byte("[")) || bytes.HasPrefix(key, []byte(reversePrefix+"[")):
+		return s.getFollows(key)
+	}
+	return s.stores[0].Get(key)
+}
+
+// Mix the probabilities of the words following key in every store.
+func (s *blendStore) getFollows(key []byte) ([]byte, error) {
+	var sum float64
+	probabilities := make(map[string]float64)
+	var order []string
+	for i, store := range s.stores {
+		data, err := store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		follows, err := decodeFollows(data)
+		if err != nil {
+			return nil, err
+		}
+		total := follows.Total()
+		if total == 0 {
+			continue
+		}
+		sum += s.weights[i]
+		for _, follow := range follows {
+			if _, ok := probabilities[follow.Word]; !ok {
+				order = append(order, follow.Word)
+			}
+			probabilities[follow.Word] += s.weights[i] * float64(follow.Count) / float64(total)
+		}
+	}
+	if len(order) == 0 {
+		return nil, nil
+	}
+
+	follows := make(Follows, len(order))
+	for i, word := range order {
+		follows[i] = Follow{word, int(math.Ceil(probabilities[word] / sum * blendScale))}
+	}
+	return json.Marshal(follows)
+}
+
+func (s *blendStore) Put(key, value []byte) error {
+	return errReadOnly
+}
+
+func (s *blendStore) Delete(key []byte) error {
+	return errReadOnly
+}
+
+// Iterate reads all the matching keys of every store in memory; it's meant
+// for short prefixes like the ones of findContext.
+func (s *blendStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return s.IterateFrom(prefix, nil, fn)
+}
+
+func (s *blendStore) IterateFrom(prefix, start []byte, fn func(key, value []byte) error) error {
+	seen := make(map[string]bool)
+	for _, store := range s.stores {
+		err := store.IterateFrom(prefix, start, func(key, value []byte) error {
+			seen[string(key)] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := s.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		if err := fn([]byte(key), value); err == ErrStopIteration {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *blendStore) NewBatch() Batch {
+	return readOnlyBatch{}
+}
+
+func (s *blendStore) Close() error {
+	return nil
+}
+
+type readOnlyBatch struct{}
+
+func (readOnlyBatch) Put(key, value []byte) {}
+func (readOnlyBatch) Delete(key []byte)     {}
+func (readOnlyBatch) Len() int              { return 0 }
+func (readOnlyBatch) Write() error          { return errReadOnly }
@@ -0,0 +1,164 @@
+package markov
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The corpus can be exported to a portable text format, to back it up, share
+// it between bots or move it to another store backend. It's made of JSON
+// objects, one per line; the first one describes the database:
+//
+//	{"dulbecco":"markov","version":1,"order":2,"min_order":1,"tokenizer":"unicode","words":5}
+//
+// and the others are ngrams, with the words following them and their counts,
+// or the number of occurrences of a word:
+//
+//	{"ngram":["the","cat"],"follows":[["sat",2],["\n",1]]}
+//	{"ngram":["sat","cat"],"reverse":true,"follows":[["the",2]]}
+//	{"word":"cat","count":3}
+//
+// The ngrams of the reverse transitions are written backwards, as they are
+// stored, and followed by the words preceding them. The ngrams and the words
+// are normalized by the tokenizer. Who contributed what (see Source) is not
+// exported.
+
+// The version of the export format.
+const ExportVersion = 1
+
+// The first line of an export.
+type ExportHeader struct {
+	Dulbecco  string `json:"dulbecco"`
+	Version   int    `json:"version"`
+	Order     int    `json:"order"`
+	MinOrder  int    `json:"min_order"`
+	Tokenizer string `json:"tokenizer"`
+	// the total number of words learned
+	Words int `json:"words"`
+}
+
+type exportRecord struct {
+	Ngram   []string `json:"ngram,omitempty"`
+	Reverse bool     `json:"reverse,omitempty"`
+	Follows Follows  `json:"follows,omitempty"`
+	Word    string   `json:"word,omitempty"`
+	Count   int      `json:"count,omitempty"`
+}
+
+// Write the whole corpus to w; returns the number of records written.
+func (mdb *MarkovDB) Export(w io.Writer) (int, error) {
+	tokenizer, err := mdb.GetMeta(metaTokenizer)
+	if err != nil {
+		return 0, err
+	}
+	words, err := mdb.TotalWords()
+	if err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	header := ExportHeader{"markov", ExportVersion, mdb.Order, mdb.MinOrder, tokenizer, words}
+	if err := enc.Encode(header); err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = mdb.store.Iterate(nil, func(key, value []byte) error {
+		var record exportRecord
+		switch {
+		case isMetaKey(key), bytes.HasPrefix(key, []byte(provenancePrefix)):
+			return nil
+		case bytes.HasPrefix(key, []byte(wordPrefix)):
+			n, err := strconv.Atoi(string(value))
+			if err != nil {
+				return fmt.Errorf("invalid count for %q: %s", key, err)
+			}
+			record = exportRecord{Word: string(key[len(wordPrefix):]), Count: n}
+		default:
+			if bytes.HasPrefix(key, []byte(reversePrefix)) {
+				record.Reverse = true
+				key = key[len(reversePrefix):]
+			}
+			if err := json.Unmarshal(key, &record.Ngram); err != nil {
+				return fmt.Errorf("invalid key %q: %s", key, err)
+			}
+			follows, err := decodeFollows(value)
+			if err != nil {
+				return err
+			}
+			record.Follows = follows
+		}
+		count++
+		return enc.Encode(record)
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+// Read the header of an export, leaving r at the first record.
+func ReadExportHeader(r *bufio.Reader) (*ExportHeader, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	var header ExportHeader
+	if err := json.Unmarshal(line, &header); err != nil || header.Dulbecco != "markov" {
+		return nil, errors.New("not a markov export")
+	}
+	if header.Version != ExportVersion {
+		return nil, fmt.Errorf("unsupported markov export version %d", header.Version)
+	}
+	return &header, nil
+}
+
+// Merge the records of an export, which follow header in r, into the
+// database, adding their counts to the ones already stored; the export must
+// have the same order, min order and tokenizer. Returns the number of records
+// read.
+func (mdb *MarkovDB) Import(header *ExportHeader, r *bufio.Reader) (int, error) {
+	tokenizer, err := mdb.GetMeta(metaTokenizer)
+	if err != nil {
+		return 0, err
+	}
+	if header.Order != mdb.Order || header.MinOrder != mdb.MinOrder || header.Tokenizer != tokenizer {
+		return 0, fmt.Errorf("the export has order %d, min_order %d and the %q tokenizer, the database order %d, min_order %d and the %q tokenizer",
+			header.Order, header.MinOrder, header.Tokenizer, mdb.Order, mdb.MinOrder, tokenizer)
+	}
+
+	trainer := mdb.NewBulkTrainer()
+	trainer.total = header.Words
+	var count int
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record exportRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return count, fmt.Errorf("record %d: %s", count+1, err)
+			}
+			if err := trainer.addRecord(&record); err != nil {
+				return count, fmt.Errorf("record %d: %s", count+1, err)
+			}
+			count++
+		}
+		if trainer.Pending() >= DefaultFlushSize || err == io.EOF {
+			if err := trainer.Flush(); err != nil {
+				return count, err
+			}
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package markov
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+)
+
+// A word following an ngram and the number of times it was seen.
+type Follow struct {
+	Word  string
+	Count int
+}
+
+// The words following an ngram; they are stored as a JSON list of [word,
+// count] pairs:
+//
+//	[["cat", 3], ["dog", 1]]
+//
+// The lists of words written by older versions, like ["cat", "dog"], are
+// still understood and each word is counted once.
+type Follows []Follow
+
+func (f Follows) MarshalJSON() ([]byte, error) {
+	pairs := make([][2]interface{}, len(f))
+	for i, follow := range f {
+		pairs[i] = [2]interface{}{follow.Word, follow.Count}
+	}
+	return json.Marshal(pairs)
+}
+
+func (f *Follows) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	result := make(Follows, 0, len(items))
+	for _, item := range items {
+		var follow Follow
+		if err := json.Unmarshal(item, &follow.Word); err == nil {
+			// old format: just the word
+			follow.Count = 1
+		} else {
+			var pair []json.RawMessage
+			if err := json.Unmarshal(item, &pair); err != nil || len(pair) != 2 {
+				return errors.New("markov: invalid follow " + string(item))
+			}
+			if err := json.Unmarshal(pair[0], &follow.Word); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(pair[1], &follow.Count); err != nil {
+				return err
+			}
+		}
+		result = append(result, follow)
+	}
+	*f = result
+	return nil
+}
+
+// Decode a stored value; nil or empty data is an empty list.
+func decodeFollows(data []byte) (Follows, error) {
+	var follows Follows
+	if len(data) == 0 {
+		return follows, nil
+	}
+	err := json.Unmarshal(data, &follows)
+	return follows, err
+}
+
+// Add n occurrences of word.
+func (f *Follows) Add(word string, n int) {
+	for i := range *f {
+		if (*f)[i].Word == word {
+			(*f)[i].Count += n
+			return
+		}
+	}
+	*f = append(*f, Follow{word, n})
+}
+
+// Remove up to n occurrences of word, and the word itself when none are
+// left; returns the number of occurrences removed.
+func (f *Follows) Remove(word string, n int) int {
+	for i := range *f {
+		if (*f)[i].Word != word {
+			continue
+		}
+		if (*f)[i].Count > n {
+			(*f)[i].Count -= n
+			return n
+		}
+		removed := (*f)[i].Count
+		*f = append((*f)[:i], (*f)[i+1:]...)
+		return removed
+	}
+	return 0
+}
+
+// Returns the total number of occurrences.
+func (f Follows) Total() int {
+	var total int
+	for _, follow := range f {
+		total += follow.Count
+	}
+	return total
+}
+
+// Pick a random word, drawn from r, with probability proportional to its
+// count; the temperature flattens (> 1) or sharpens (< 1) the distribution,
+// 0 or 1 leave it unchanged.
+func (f Follows) Pick(r *rand.Rand, temperature float64) string {
+	if len(f) == 0 {
+		return ""
+	}
+	if temperature <= 0 {
+		temperature = 1
+	}
+
+	weights := make([]float64, len(f))
+	var total float64
+	for i, follow := range f {
+		weights[i] = math.Pow(float64(follow.Count), 1/temperature)
+		total += weights[i]
+	}
+
+	x := r.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return f[i].Word
+		}
+		x -= w
+	}
+	return f[len(f)-1].Word
+}
@@ -0,0 +1,295 @@
+package markov
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Who wrote a sentence. When Options.Provenance is set the transitions and
+// the words learned from each nick are also counted apart, so that they can
+// be removed by Forget.
+//
+// Provenance is recorded per nick only (case insensitive), not per account
+// or hostmask: what a user said under another nick is not forgotten with
+// their nick, and what someone else said under that nick is.
+type Source struct {
+	Nick    string
+	Channel string
+}
+
+// Number of keys changed by each batch of Forget and Purge.
+const forgetBatchSize = 10000
+
+func (mdb *MarkovDB) tracks(source Source) bool {
+	return mdb.Provenance && source.Nick != ""
+}
+
+func sourcePrefix(nick, channel string) []byte {
+	prefix := provenancePrefix + strings.ToLower(nick) + "\x00"
+	if channel != "" {
+		prefix += strings.ToLower(channel) + "\x00"
+	}
+	return []byte(prefix)
+}
+
+// Returns the key counting what source contributed to key.
+func provenanceKey(source Source, key []byte) []byte {
+	prefix := provenancePrefix + strings.ToLower(source.Nick) + "\x00" + strings.ToLower(source.Channel) + "\x00"
+	return append([]byte(prefix), key...)
+}
+
+// Returns the key a provenance key counts the contributions to.
+func provenanceTarget(key []byte) []byte {
+	key = key[len(provenancePrefix):]
+	for i := 0; i < 2; i++ {
+		if n := bytes.IndexByte(key, 0); n >= 0 {
+			key = key[n+1:]
+		}
+	}
+	return key
+}
+
+// Write follows to key, deleting it when it's empty.
+func putFollows(batch Batch, key []byte, follows Follows) error {
+	if len(follows) == 0 {
+		batch.Delete(key)
+		return nil
+	}
+	data, err := json.Marshal(follows)
+	if err != nil {
+		return err
+	}
+	batch.Put(key, data)
+	return nil
+}
+
+// Write a word count to key, deleting it when it's zero.
+func putCount(batch Batch, key []byte, count int) {
+	if count <= 0 {
+		batch.Delete(key)
+	} else {
+		batch.Put(key, []byte(strconv.Itoa(count)))
+	}
+}
+
+// Remove what nick said in channel, or in every channel if channel is "",
+// from the corpus. Only what was learned with Options.Provenance set can be
+// removed, and only under that nick: see Source. Returns the number of
+// transitions removed.
+func (mdb *MarkovDB) Forget(nick, channel string) (int, error) {
+	prefix := sourcePrefix(nick, channel)
+	var total int
+	for {
+		n, more, err := mdb.forgetBatch(prefix)
+		total += n
+		if err != nil || !more {
+			return total, err
+		}
+	}
+}
+
+// Subtract the contributions found under prefix, up to forgetBatchSize of
+// them, and delete them; returns true if there are more left.
+func (mdb *MarkovDB) forgetBatch(prefix []byte) (int, bool, error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	follows := make(map[string]Follows)
+	words := make(map[string]int)
+	var keys [][]byte
+	err := mdb.store.Iterate(prefix, func(key, value []byte) error {
+		target := string(provenanceTarget(key))
+		if strings.HasPrefix(target, wordPrefix) {
+			n, err := strconv.Atoi(string(value))
+			if err != nil {
+				return err
+			}
+			words[target] += n
+		} else {
+			contributed, err := decodeFollows(value)
+			if err != nil {
+				return err
+			}
+			merged := follows[target]
+			for _, follow := range contributed {
+				merged.Add(follow.Word, follow.Count)
+			}
+			follows[target] = merged
+		}
+		keys = append(keys, append([]byte(nil), key...))
+		if len(keys) >= forgetBatchSize {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, false, err
+	}
+
+	batch := mdb.store.NewBatch()
+	var removed int
+	for key, contributed := range follows {
+		stored, err := mdb.GetFollows([]byte(key))
+		if err != nil {
+			return 0, false, err
+		}
+		for _, follow := range contributed {
+			removed += stored.Remove(follow.Word, follow.Count)
+		}
+		if err := putFollows(batch, []byte(key), stored); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := mdb.subtractWords(batch, words); err != nil {
+		return 0, false, err
+	}
+	for _, key := range keys {
+		batch.Delete(key)
+	}
+	return removed, len(keys) >= forgetBatchSize, batch.Write()
+}
+
+// Subtract the given counts from the word keys and from the total.
+func (mdb *MarkovDB) subtractWords(batch Batch, words map[string]int) error {
+	if len(words) == 0 {
+		return nil
+	}
+	var removed int
+	for key, n := range words {
+		count, err := mdb.readCount([]byte(key))
+		if err != nil {
+			return err
+		}
+		if n > count {
+			n = count
+		}
+		removed += n
+		putCount(batch, []byte(key), count-n)
+	}
+	total, err := mdb.readCount(metaKey(metaWords))
+	if err != nil {
+		return err
+	}
+	putCount(batch, metaKey(metaWords), total-removed)
+	return nil
+}
+
+// Remove from the corpus every transition whose text matches re, i.e. a
+// password pasted in a channel. The text of a transition is made of the
+// words of its ngram, normalized by the tokenizer, and of the following word
+// as it was written, separated by spaces. Returns the number of transitions
+// removed.
+func (mdb *MarkovDB) Purge(re *regexp.Regexp) (int, error) {
+	var total int
+	var start []byte
+	for {
+		n, next, err := mdb.purgeBatch(re, start)
+		total += n
+		if err != nil || next == nil {
+			return total, err
+		}
+		start = next
+	}
+}
+
+// Purge the keys from start until forgetBatchSize of them are changed;
+// returns the key to continue from, or nil at the end of the store.
+func (mdb *MarkovDB) purgeBatch(re *regexp.Regexp, start []byte) (int, []byte, error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	batch := mdb.store.NewBatch()
+	var removed, removedWords int
+	var next []byte
+	err := mdb.store.IterateFrom(nil, start, func(key, value []byte) error {
+		if isMetaKey(key) {
+			return nil
+		}
+
+		target, tracked := key, bytes.HasPrefix(key, []byte(provenancePrefix))
+		if tracked {
+			target = provenanceTarget(key)
+		}
+		if bytes.HasPrefix(target, []byte(wordPrefix)) {
+			if !re.MatchString(string(target[len(wordPrefix):])) {
+				return nil
+			}
+			batch.Delete(key)
+			if !tracked {
+				n, err := strconv.Atoi(string(value))
+				if err != nil {
+					return err
+				}
+				removedWords += n
+			}
+		} else {
+			n, err := mdb.purgeFollows(batch, re, key, target, value)
+			if err != nil {
+				return err
+			}
+			if !tracked {
+				removed += n
+			}
+		}
+
+		if batch.Len() >= forgetBatchSize {
+			next = keyAfter(key)
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if removedWords > 0 {
+		total, err := mdb.readCount(metaKey(metaWords))
+		if err != nil {
+			return 0, nil, err
+		}
+		putCount(batch, metaKey(metaWords), total-removedWords)
+	}
+	return removed, next, batch.Write()
+}
+
+// Remove the words whose transition matches re from the list stored in key,
+// an ngram or the provenance of one; returns the occurrences removed.
+func (mdb *MarkovDB) purgeFollows(batch Batch, re *regexp.Regexp, key, target, value []byte) (int, error) {
+	reversed := bytes.HasPrefix(target, []byte(reversePrefix))
+	if reversed {
+		target = target[len(reversePrefix):]
+	}
+	var ngram []string
+	if err := json.Unmarshal(target, &ngram); err != nil {
+		return 0, err
+	}
+	if reversed {
+		ngram = reverse(ngram)
+	}
+	follows, err := decodeFollows(value)
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+	for _, follow := range append(Follows(nil), follows...) {
+		words := ngram
+		switch {
+		case follow.Word == "\n":
+		case reversed:
+			words = append([]string{follow.Word}, ngram...)
+		default:
+			words = append(ngram[:len(ngram):len(ngram)], follow.Word)
+		}
+		if re.MatchString(strings.Join(words, " ")) {
+			removed += follows.Remove(follow.Word, follow.Count)
+		}
+	}
+	if removed > 0 {
+		return removed, putFollows(batch, key, follows)
+	}
+	return 0, nil
+}
@@ -0,0 +1,87 @@
+package markov
+
+import (
+	"strconv"
+)
+
+// The keys of the different kinds of records share the same store:
+//
+//	["a","b"]     the words following the ngram "a b"
+//	r["b","a"]    the words preceding the ngram "a b" (reverse transitions)
+//	wa            the number of occurrences of the word "a"
+//	pnick\x00#chan\x00<key>
+//	              what nick contributed in #chan to one of the keys above,
+//	              see Source
+//	\x00meta:...  metadata, see meta.go
+const (
+	forwardPrefix    = ""
+	reversePrefix    = "r"
+	wordPrefix       = "w"
+	provenancePrefix = "p"
+)
+
+// the metadata entry with the total number of words learned
+const metaWords = "words"
+
+func makePrefixedKey(prefix string, ngram []string) ([]byte, error) {
+	key, err := MakeKey(ngram)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(prefix), key...), nil
+}
+
+func wordKey(word string) []byte {
+	return []byte(wordPrefix + word)
+}
+
+// Count the occurrences of words, written by source; the total is kept in the
+// metadata.
+func (mdb *MarkovDB) countWords(words []string, source Source) error {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	batch := mdb.store.NewBatch()
+	counts := make(map[string]int)
+	for _, word := range words {
+		counts[mdb.Tokenizer.Normalize(word)]++
+	}
+	for word, n := range counts {
+		count, err := mdb.readCount(wordKey(word))
+		if err != nil {
+			return err
+		}
+		batch.Put(wordKey(word), []byte(strconv.Itoa(count+n)))
+		if mdb.tracks(source) {
+			key := provenanceKey(source, wordKey(word))
+			if count, err = mdb.readCount(key); err != nil {
+				return err
+			}
+			batch.Put(key, []byte(strconv.Itoa(count+n)))
+		}
+	}
+	total, err := mdb.readCount(metaKey(metaWords))
+	if err != nil {
+		return err
+	}
+	batch.Put(metaKey(metaWords), []byte(strconv.Itoa(total+len(words))))
+	return batch.Write()
+}
+
+func (mdb *MarkovDB) readCount(key []byte) (int, error) {
+	data, err := mdb.store.Get(key)
+	if err != nil || len(data) == 0 {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+// Returns the number of times word was seen.
+func (mdb *MarkovDB) WordCount(word string) (int, error) {
+	return mdb.readCount(wordKey(mdb.Tokenizer.Normalize(word)))
+}
+
+// Returns the total number of words learned.
+func (mdb *MarkovDB) TotalWords() (int, error) {
+	return mdb.readCount(metaKey(metaWords))
+}
@@ -0,0 +1,147 @@
+package markov
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Words too common to be the subject of a reply, in English and Italian;
+// more can be added with Options.Stopwords.
+var defaultStopwords = []string{
+	// English
+	"a", "about", "all", "an", "and", "are", "as", "at", "be", "been", "but",
+	"by", "can", "do", "does", "for", "from", "had", "has", "have", "he",
+	"her", "him", "his", "how", "i", "if", "in", "is", "it", "its", "me",
+	"my", "no", "not", "of", "on", "or", "our", "she", "so", "that", "the",
+	"their", "them", "then", "there", "they", "this", "to", "too", "up",
+	"us", "was", "we", "what", "when", "where", "which", "who", "why",
+	"will", "with", "would", "yes", "you", "your",
+	// Italian
+	"a", "ad", "al", "alla", "anche", "che", "chi", "ci", "come", "con",
+	"cosa", "da", "dal", "dei", "del", "della", "di", "e", "è", "gli", "ha",
+	"ho", "i", "il", "in", "io", "la", "le", "lo", "ma", "mi", "ne", "nel",
+	"no", "non", "o", "per", "più", "quando", "se", "si", "sono", "su",
+	"ti", "tu", "tutto", "un", "una", "uno", "va",
+}
+
+// Returns the lowercase word without surrounding punctuation.
+func stopwordForm(word string) string {
+	return strings.ToLower(strings.TrimFunc(word, unicode.IsPunct))
+}
+
+func makeStopwords(extra []string) map[string]bool {
+	stopwords := make(map[string]bool)
+	for _, list := range [][]string{defaultStopwords, extra} {
+		for _, word := range list {
+			stopwords[stopwordForm(word)] = true
+		}
+	}
+	return stopwords
+}
+
+func (mdb *MarkovDB) isStopword(word string) bool {
+	form := stopwordForm(word)
+	return form == "" || mdb.stopwords[form]
+}
+
+// Returns the words of the input a reply could be about, i.e. the known
+// words which are not stopwords, in their normalized form with the number of
+// times they were seen.
+func (mdb *MarkovDB) keywords(words []string) map[string]int {
+	keywords := make(map[string]int)
+	for _, word := range words {
+		if mdb.isStopword(word) {
+			continue
+		}
+		if count, err := mdb.WordCount(word); err == nil && count > 0 {
+			keywords[mdb.Tokenizer.Normalize(word)] = count
+		}
+	}
+	return keywords
+}
+
+// Choose the keyword a reply should be about: the rarest one, since it says
+// the most about the input; returns "" if there are none.
+func (mdb *MarkovDB) keyword(keywords map[string]int) string {
+	var best []string
+	var bestCount int
+	for word, count := range keywords {
+		if best == nil || count < bestCount {
+			best, bestCount = []string{word}, count
+		} else if count == bestCount {
+			best = append(best, word)
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	// map iteration order is random, but not uniformly
+	sort.Strings(best)
+	return best[mdb.rand.Intn(len(best))]
+}
+
+// Max number of ngrams considered by findContext.
+const maxContexts = 100
+
+// Returns a random ngram of Order (normalized) words starting with keyword,
+// looking at the reverse transitions when keyword is only found at the end of
+// sentences; returns nil if there are none.
+func (mdb *MarkovDB) findContext(keyword string) []string {
+	for _, prefix := range []string{forwardPrefix, reversePrefix} {
+		key, err := makePrefixedKey(prefix, []string{keyword})
+		if err != nil {
+			return nil
+		}
+		if mdb.Order > 1 {
+			// ["keyword"] -> ["keyword",
+			key[len(key)-1] = ','
+		}
+
+		var context []string
+		var seen int
+		mdb.store.Iterate(key, func(key, value []byte) error {
+			var ngram []string
+			if err := json.Unmarshal(key[len(prefix):], &ngram); err != nil || len(ngram) != mdb.Order {
+				return nil
+			}
+			// reservoir sampling
+			seen++
+			if mdb.rand.Intn(seen) == 0 {
+				context = ngram
+			}
+			if seen >= maxContexts {
+				return ErrStopIteration
+			}
+			return nil
+		})
+
+		if context != nil {
+			if prefix == reversePrefix {
+				return reverse(context)
+			}
+			return context
+		}
+	}
+	return nil
+}
+
+// Generate a phrase about keyword, by extending one of its contexts
+// backwards to the start of a sentence and then forwards to its end; returns
+// "" if keyword was never seen.
+func (mdb *MarkovDB) around(keyword string) string {
+	phrase := mdb.findContext(keyword)
+	if phrase == nil {
+		return ""
+	}
+
+	for i := 0; i < MaxPhraseLength; i++ {
+		word, err := mdb.prev(phrase)
+		if err != nil || word == "\n" {
+			break
+		}
+		phrase = append([]string{word}, phrase...)
+	}
+	return mdb.Goo(phrase)
+}
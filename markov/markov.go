@@ -3,11 +3,13 @@ package markov
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/jmhodges/levigo"
+	"io"
 	"log"
 	"math/rand"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
 )
@@ -17,13 +19,18 @@ var (
 )
 
 func tokenize(order int, sentence string) ([][]string, error) {
+	return ngrams(order, strings.Fields(sentence))
+}
+
+// Returns the ngrams of words, each one followed by the next word; the last
+// one is followed by "\n".
+func ngrams(order int, words []string) ([][]string, error) {
 	var result [][]string
 
-	words := strings.Fields(sentence)
 	if len(words) < order {
 		return result, fmt.Errorf("Sentence too short for order %d\n", order)
 	}
-	words = append(words, "\n")
+	words = append(words[:len(words):len(words)], "\n")
 
 	for i := 0; i < len(words)-order; i++ {
 		ngram := words[i : i+order+1]
@@ -36,187 +43,321 @@ func MakeKey(ngram []string) ([]byte, error) {
 	return json.Marshal(ngram)
 }
 
-type MarkovDB struct {
+// Returns a copy of words in reverse order.
+func reverse(words []string) []string {
+	result := make([]string, len(words))
+	for i, word := range words {
+		result[len(words)-1-i] = word
+	}
+	return result
+}
+
+// Options of a MarkovDB; Order and MinOrder are saved in the database and
+// must not change once it contains data.
+type Options struct {
+	// number of words of the ngrams
 	Order int
-	Db    *levigo.DB
-	mutex sync.Mutex
+	// the shortest ngrams learned and used when a longer context was never
+	// seen; 0 means Order, i.e. no backoff.
+	MinOrder int
+	// flattens (> 1) or sharpens (< 1) the distribution of the following
+	// words; see Follows.Pick
+	Temperature float64
+	// words never chosen as the subject of a reply, besides the default
+	// English and Italian ones
+	Stopwords []string
+	// how replies are chosen; the zero value means DefaultScoring
+	Scoring Scoring
+	// name of the tokenizer, saved in the database; "" means the one the
+	// database was created with, or DefaultTokenizer for new databases.
+	Tokenizer string
+	// count what each nick contributes, so that it can be removed by Forget;
+	// it's per nick only, see Source
+	Provenance bool
+	// regular expressions matching the sentences that must not be learned;
+	// see also Purge
+	Blocklist []string
+	// the source of the random choices of the generation, i.e.
+	// rand.NewSource(1) for reproducible output; nil means the global source
+	// of math/rand
+	Rand rand.Source
 }
 
-func NewMarkovDB(order int, dbfile string) (*MarkovDB, error) {
-	opts := levigo.NewOptions()
-	opts.SetCache(levigo.NewLRUCache(3 << 29))
-	opts.SetCreateIfMissing(true)
-	db, err := levigo.Open(dbfile, opts)
-	if err != nil {
-		return nil, err
+type MarkovDB struct {
+	Order       int
+	MinOrder    int
+	Temperature float64
+	Scoring     Scoring
+	Tokenizer   Tokenizer
+	Provenance  bool
+	store       Store
+	blocklist   []*regexp.Regexp
+	stopwords   map[string]bool
+	rand        *rand.Rand
+	mutex       sync.Mutex
+}
+
+// Create a MarkovDB reading and writing the corpus in store; the store is
+// closed by Close. Databases written by older versions are converted.
+func NewMarkovDB(store Store, opts Options) (*MarkovDB, error) {
+	if opts.MinOrder == 0 {
+		opts.MinOrder = opts.Order
+	}
+	if opts.Order < 1 || opts.MinOrder < 1 || opts.MinOrder > opts.Order {
+		return nil, fmt.Errorf("invalid markov order %d (min order %d)", opts.Order, opts.MinOrder)
 	}
 
 	mdb := &MarkovDB{
-		Order: order,
-		Db:    db,
+		Order:       opts.Order,
+		MinOrder:    opts.MinOrder,
+		Temperature: opts.Temperature,
+		Provenance:  opts.Provenance,
+		store:       store,
+		Scoring:     opts.Scoring.withDefaults(),
+		stopwords:   makeStopwords(opts.Stopwords),
+		rand:        NewRand(opts.Rand),
+	}
+	for _, pattern := range opts.Blocklist {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid markov blocklist pattern %q: %s", pattern, err)
+		}
+		mdb.blocklist = append(mdb.blocklist, re)
+	}
+	if err := mdb.upgrade(); err != nil {
+		return nil, err
+	}
+	if err := mdb.checkOrder(); err != nil {
+		return nil, err
+	}
+	if err := mdb.checkTokenizer(opts.Tokenizer); err != nil {
+		return nil, err
 	}
 
 	return mdb, nil
 }
 
-func (mdb *MarkovDB) ReadSentence(sentence string) {
-	tokens, err := tokenize(mdb.Order, sentence)
+// Open the corpus found at path with the named store backend.
+func OpenMarkovDB(backend, path string, opts Options) (*MarkovDB, error) {
+	store, err := OpenStore(backend, path)
+	if err != nil {
+		return nil, err
+	}
+	mdb, err := NewMarkovDB(store, opts)
 	if err != nil {
-		// log.Printf("ReadSentence error: %s\n", err)
+		store.Close()
+		return nil, err
+	}
+	return mdb, nil
+}
+
+// Returns the underlying store.
+func (mdb *MarkovDB) Store() Store {
+	return mdb.store
+}
+
+// Learn the ngrams of sentence, of every length between MinOrder and Order,
+// both forwards and backwards, and the frequency of its words.
+func (mdb *MarkovDB) ReadSentence(sentence string) {
+	mdb.Learn(sentence, Source{})
+}
+
+// Learn sentence like ReadSentence, recording that source wrote it.
+func (mdb *MarkovDB) Learn(sentence string, source Source) {
+	if mdb.Blocked(sentence) {
 		return
 	}
+	words := mdb.Tokenizer.Tokenize(sentence)
+	if len(words) < mdb.MinOrder {
+		return
+	}
+	for _, t := range mdb.transitions(words) {
+		if err := mdb.Put(t.key, t.word); err != nil {
+			log.Print("ReadSentence put error: ", err)
+		}
+		if mdb.tracks(source) {
+			if err := mdb.Put(provenanceKey(source, t.key), t.word); err != nil {
+				log.Print("ReadSentence put error: ", err)
+			}
+		}
+	}
+	if err := mdb.countWords(words, source); err != nil {
+		log.Print("ReadSentence error: ", err)
+	}
+}
+
+// Returns true if sentence matches the blocklist.
+func (mdb *MarkovDB) Blocked(sentence string) bool {
+	for _, re := range mdb.blocklist {
+		if re.MatchString(sentence) {
+			return true
+		}
+	}
+	return false
+}
+
+// A word following an ngram, or preceding it for the reverse transitions.
+type transition struct {
+	key  []byte
+	word string
+}
+
+// Returns the transitions found in words, of every length between MinOrder
+// and Order and in both directions.
+func (mdb *MarkovDB) transitions(words []string) []transition {
+	var result []transition
+	for order := mdb.MinOrder; order <= mdb.Order; order++ {
+		forward, ok := mdb.readTokens(forwardPrefix, order, words)
+		if !ok {
+			// too short for this order and for the longer ones
+			break
+		}
+		backward, _ := mdb.readTokens(reversePrefix, order, reverse(words))
+		result = append(result, forward...)
+		result = append(result, backward...)
+	}
+	return result
+}
+
+func (mdb *MarkovDB) readTokens(prefix string, order int, words []string) ([]transition, bool) {
+	tokens, err := ngrams(order, words)
+	if err != nil {
+		return nil, false
+	}
+	var result []transition
 	for _, token := range tokens {
-		ngram := token[0 : len(token)-1]
+		// the keys are normalized, the following words are kept as written
+		ngram := normalize(mdb.Tokenizer, token[0:len(token)-1])
 		follow := token[len(token)-1]
-		key, err := MakeKey(ngram)
+		key, err := makePrefixedKey(prefix, ngram)
 		if err != nil {
 			log.Print("ReadSentence error: ", err)
-			return
-		}
-		if err := mdb.Put(key, follow); err != nil {
-			log.Print("ReadSentence put error: ", err)
+			return nil, false
 		}
+		result = append(result, transition{key, follow})
 	}
+	return result, true
 }
 
+// Count one more occurrence of the word value following the ngram key.
 func (mdb *MarkovDB) Put(key []byte, value string) error {
-	ro := levigo.NewReadOptions()
-	wo := levigo.NewWriteOptions()
-	defer ro.Close()
-	defer wo.Close()
+	return mdb.PutCount(key, value, 1)
+}
+
+// Count n more occurrences of the word value following the ngram key.
+func (mdb *MarkovDB) PutCount(key []byte, value string, n int) error {
+	// concurrent access is OK as long as we don't update the same key at the
+	// same time, so better use a lock
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
 
 	// get existing value for key
-	jsonwords, err := mdb.Db.Get(ro, key)
+	data, err := mdb.store.Get(key)
 	if err != nil {
 		return err
 	}
 
 	// deserialize existing value, if any
-	var words []string
-	if jsonwords != nil && string(jsonwords) != "" {
-		err = json.Unmarshal(jsonwords, &words)
-		if err != nil {
-			return err
-		}
+	follows, err := decodeFollows(data)
+	if err != nil {
+		return err
 	}
 
-	// append the new word to the value and serialize the result
-	for _, word := range words {
-		if word == value {
-			return nil
-		}
-	}
-	words = append(words, value)
-	newwords, err := json.Marshal(words)
+	// count the new word and serialize the result
+	follows.Add(value, n)
+	data, err = json.Marshal(follows)
 	if err != nil {
 		return err
 	}
 
 	// write the new value to the db
-	// concurrent access is OK as long as we don't write the same key at the same time,
-	// so better use a lock
-	mdb.mutex.Lock()
-	defer mdb.mutex.Unlock()
-
-	err = mdb.Db.Put(wo, key, newwords)
-	return err
+	return mdb.store.Put(key, data)
 }
 
-func (mdb *MarkovDB) Generate(seed string) string {
-	ro := levigo.NewReadOptions()
-	defer ro.Close()
-
-	var phrases []string
-
-	tokens, err := tokenize(mdb.Order, seed)
+// Returns the words following the ngram key with their counts.
+func (mdb *MarkovDB) GetFollows(key []byte) (Follows, error) {
+	data, err := mdb.store.Get(key)
 	if err != nil {
-		return ""
-	}
-	for _, token := range tokens {
-		ngram := token[0 : len(token)-1]
-		// fmt.Printf("ngram = %q\n", ngram)
-
-		phrase := mdb.Goo(ngram)
-		if phrase == seed {
-			continue
-		}
-		phrases = append(phrases, phrase)
-		// fmt.Printf("* phrase %d: %s\n", i, phrase)
-	}
-
-	var result string
-	for _, phrase := range phrases {
-		if len(phrase) > len(result) {
-			result = phrase
-		}
+		return nil, err
 	}
-
-	// fmt.Printf("%s\n", result)
-
-	return result
+	return decodeFollows(data)
 }
 
 func (mdb *MarkovDB) Goo(ngramKey []string) string {
-	key, err := MakeKey(ngramKey)
-	if err != nil {
-		log.Print("Goo error (MakeKey): ", err)
-		return ""
-	}
 	var result []string = make([]string, len(ngramKey))
 	copy(result, ngramKey)
 
-	// fmt.Printf("result (1): %q (%q)\n", result, ngramKey)
-
 	for i := 0; i < MaxPhraseLength; i++ {
-		followWord, err := mdb.GetRandom(key)
+		followWord, err := mdb.next(result)
 		if err != nil || followWord == "\n" {
-			// fmt.Printf("no follow for %s\n", key)
-			break
-		}
-		if followWord == "\n" {
 			break
 		}
 		result = append(result, followWord)
-		ngramKey = append(ngramKey[1:], followWord)
-		key, err = MakeKey(ngramKey)
-		if err != nil {
-			break
-		}
 	}
-	return strings.Join(result, " ")
+	return mdb.Tokenizer.Join(result)
 }
 
-func (mdb *MarkovDB) GetRandom(key []byte) (string, error) {
-	ro := levigo.NewReadOptions()
-	defer ro.Close()
+// Pick a word following the last Order words of phrase.
+func (mdb *MarkovDB) next(phrase []string) (string, error) {
+	return mdb.pick(forwardPrefix, phrase)
+}
 
-	jsondata, err := mdb.Db.Get(ro, key)
-	if err != nil {
-		return "", nil
+// Pick a word preceding the first Order words of phrase.
+func (mdb *MarkovDB) prev(phrase []string) (string, error) {
+	if len(phrase) > mdb.Order {
+		phrase = phrase[:mdb.Order]
 	}
+	return mdb.pick(reversePrefix, reverse(phrase))
+}
 
-	var follows []string
-	if jsondata == nil || string(jsondata) == "" {
-		return "", fmt.Errorf("no value for this key: %s\n", key)
+// Pick the word coming after context, whose last word is the nearest to it,
+// in the transitions of the given direction; if the last Order words of
+// context were never seen together, back off to shorter contexts down to
+// MinOrder words.
+func (mdb *MarkovDB) pick(prefix string, context []string) (string, error) {
+	n := mdb.Order
+	if len(context) < n {
+		n = len(context)
+	}
+	for ; n >= mdb.MinOrder; n-- {
+		key, err := makePrefixedKey(prefix, normalize(mdb.Tokenizer, context[len(context)-n:]))
+		if err != nil {
+			return "", err
+		}
+		follows, err := mdb.GetFollows(key)
+		if err != nil {
+			return "", err
+		}
+		if len(follows) > 0 {
+			return follows.Pick(mdb.rand, mdb.Temperature), nil
+		}
 	}
-	err = json.Unmarshal(jsondata, &follows)
+	return "", errors.New("unknown context")
+}
+
+func (mdb *MarkovDB) GetRandom(key []byte) (string, error) {
+	follows, err := mdb.GetFollows(key)
 	if err != nil {
 		return "", err
 	}
+	if len(follows) == 0 {
+		return "", fmt.Errorf("no value for this key: %s\n", key)
+	}
 
-	word := follows[rand.Intn(len(follows))]
+	// words seen more often are more likely to be chosen
+	word := follows.Pick(mdb.rand, mdb.Temperature)
 
 	// fmt.Printf("random for %q: %q\n", key, word)
 
 	return word, nil
 }
 
-func (mdb *MarkovDB) Close() {
-	mdb.Db.Close()
+func (mdb *MarkovDB) Close() error {
+	return mdb.store.Close()
 }
 
 func TestMarkov() {
-	mdb, err := NewMarkovDB(2, "petodb")
+	mdb, err := OpenMarkovDB(DefaultBackend, "petodb", Options{Order: 2})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -234,13 +375,11 @@ func TestMarkov() {
 	}
 }
 
-func ReadStdin(dbpath string, order int) {
-	mdb, err := NewMarkovDB(order, dbpath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer mdb.Close()
-
+// Read the legacy import format from the standard input: alternating lines
+// with a JSON encoded ngram and a word following it, as written by
+// utils/sputa.py. See Export for the current format. The ngrams are
+// normalized by the tokenizer of the database.
+func ReadStdin(mdb *MarkovDB) {
 	i := 1
 	var buf string
 
@@ -258,8 +397,14 @@ func ReadStdin(dbpath string, order int) {
 		}
 
 		if i%2 == 0 {
-			fmt.Printf("Put %s -> %q\n", buf, text)
-			mdb.Put([]byte(buf), text)
+			var ngram []string
+			if err := json.Unmarshal([]byte(buf), &ngram); err != nil {
+				log.Printf("Invalid ngram %q: %s", buf, err)
+			} else if key, err := MakeKey(normalize(mdb.Tokenizer, ngram)); err != nil {
+				log.Print(err)
+			} else if err := mdb.Put(key, text); err != nil {
+				log.Print(err)
+			}
 		} else {
 			buf = text
 		}
@@ -268,23 +413,10 @@ func ReadStdin(dbpath string, order int) {
 	}
 }
 
-// To read from a IRC log file with a format like:
-//
-//    Dec 19 15:24:41 <user>    hello world!
-//
-// You can cleanup the log running:
-//
-// awk '$4 ~ /^</ { print }' < irc.log | cut -d '>' -f 2- | sed 's/^_TAB_//'
-//
-// Where _TAB_ is 'C-v TAB' from a bash shell.
-
-func ReadFile(dbpath, filename string, order int) error {
-	mdb, err := NewMarkovDB(order, dbpath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer mdb.Close()
-
+// Learn every line of a text file, one sentence per line; IRC logs can be
+// read with "dulbecco train", which understands the formats of the most
+// common clients.
+func ReadFile(mdb *MarkovDB, filename string) error {
 	var reader *bufio.Reader
 
 	if filename == "-" {
@@ -294,15 +426,26 @@ func ReadFile(dbpath, filename string, order int) error {
 		if err != nil {
 			return err
 		}
+		defer file.Close()
 		reader = bufio.NewReader(file)
 	}
 
+	trainer := mdb.NewBulkTrainer()
 	for {
 		line, err := reader.ReadString('\n')
-		if err != nil {
+		if err != nil && err != io.EOF {
 			return err
 		}
-		line = strings.TrimRight(line, "\r\n")
-		mdb.ReadSentence(line)
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			trainer.Add(line, Source{})
+		}
+		if trainer.Pending() >= DefaultFlushSize || err == io.EOF {
+			if err := trainer.Flush(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
 	}
 }
@@ -1,7 +1,16 @@
 package markov
 
 import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestTokenize(t *testing.T) {
@@ -31,3 +40,485 @@ func TestTokenize(t *testing.T) {
 		}
 	}
 }
+
+func TestFollowsFormats(t *testing.T) {
+	old, err := decodeFollows([]byte(`["cat","dog"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 2 || old[0] != (Follow{"cat", 1}) || old[1] != (Follow{"dog", 1}) {
+		t.Fatalf("old format decoded as %v", old)
+	}
+
+	old.Add("cat", 2)
+	data, err := old.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `[["cat",3],["dog",1]]` {
+		t.Fatalf("encoded as %s", data)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put([]byte(`["a","b"]`), []byte(`["c","d"]`))
+	store.Put([]byte(`["b","c"]`), []byte(`["\n"]`))
+
+	mdb, err := NewMarkovDB(store, Options{Order: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format, _ := mdb.GetMeta(metaFormat); format != formatCounts {
+		t.Fatalf("format = %q", format)
+	}
+	if data, _ := store.Get([]byte(`["a","b"]`)); string(data) != `[["c",1],["d",1]]` {
+		t.Fatalf("converted value = %s", data)
+	}
+
+	mdb.Put([]byte(`["a","b"]`), "c")
+	follows, err := mdb.GetFollows([]byte(`["a","b"]`))
+	if err != nil || follows.Total() != 3 {
+		t.Fatalf("follows = %v, %v", follows, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	mdb, err := NewMarkovDB(NewMemoryStore(), Options{Order: 2, MinOrder: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb.ReadSentence("the cat sat")
+	mdb.ReadSentence("a cat ran")
+
+	if word, err := mdb.next([]string{"the", "dog"}); err == nil {
+		t.Fatalf("unexpected follow %q", word)
+	}
+	// "my cat" was never seen, so "cat" alone is used as the context
+	if word, err := mdb.next([]string{"my", "cat"}); err != nil || (word != "sat" && word != "ran") {
+		t.Fatalf("next(my cat) = %q, %v", word, err)
+	}
+
+	// the order is saved in the database
+	if _, err := NewMarkovDB(mdb.Store(), Options{Order: 3}); err == nil {
+		t.Fatal("opened a database with the wrong order")
+	}
+	if _, err := NewMarkovDB(mdb.Store(), Options{Order: 2, MinOrder: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateAround(t *testing.T) {
+	mdb, err := NewMarkovDB(NewMemoryStore(), Options{Order: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb.ReadSentence("I think the weather is nice today")
+	mdb.ReadSentence("my dog is nice")
+	mdb.ReadSentence("my dog likes walks")
+
+	if keyword := mdb.keyword(mdb.keywords([]string{"is", "the", "weather", "nice"})); keyword != "weather" {
+		t.Fatalf("keyword = %q", keyword)
+	}
+	// "today" is only found at the end of a sentence
+	reply := mdb.around("today")
+	if reply != "I think the weather is nice today" && reply != "my dog is nice today" {
+		t.Fatalf("reply = %q", reply)
+	}
+	if keywords := mdb.keywords([]string{"the", "the", "unknown"}); len(keywords) != 0 {
+		t.Fatalf("keywords = %v", keywords)
+	}
+
+	// the reply repeating the last output is discarded; with enough
+	// candidates the other one is always generated.
+	mdb.Scoring.Candidates = 60
+	mdb.Scoring.Budget = time.Minute
+	last := "I think the weather is nice today"
+	for i := 0; i < 10; i++ {
+		if reply := mdb.GenerateReply("today", []string{last}); reply != "my dog is nice today" {
+			t.Fatalf("GenerateReply() = %q", reply)
+		}
+	}
+}
+
+func TestUnicodeTokenizer(t *testing.T) {
+	tokenizer := unicodeTokenizer{}
+	tests := []struct {
+		text   string
+		tokens []string
+		joined string
+	}{
+		{"Ciao!", []string{"Ciao", "!"}, "Ciao!"},
+		{"pinolo: I can't see (it)... :-)", []string{"I", "can't", "see", "(", "it", ")", "...", ":-)"}, "I can't see (it)... :-)"},
+		{"ciao :) (wow!) 3.14", []string{"ciao", ":)", "(", "wow", "!", ")", "3.14"}, "ciao :) (wow!) 3.14"},
+		{"look at http://example.com/x?y=1 now", []string{"look", "at", "now"}, "look at now"},
+		{"\x02bold\x02 \x0304,01red\x03 l'acqua è più blu", []string{"bold", "red", "l'acqua", "è", "più", "blu"}, "bold red l'acqua è più blu"},
+	}
+
+	for _, test := range tests {
+		tokens := tokenizer.Tokenize(test.text)
+		if !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("Tokenize(%q) = %q, expected %q", test.text, tokens, test.tokens)
+		}
+		if joined := tokenizer.Join(tokens); joined != test.joined {
+			t.Errorf("Join(%q) = %q, expected %q", tokens, joined, test.joined)
+		}
+	}
+}
+
+func TestTokenizerMeta(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put([]byte(`["a","b"]`), []byte(`[["c",1]]`))
+
+	// existing databases keep splitting on spaces
+	mdb, err := NewMarkovDB(store, Options{Order: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mdb.Tokenizer.(fieldsTokenizer); !ok {
+		t.Fatalf("tokenizer = %T", mdb.Tokenizer)
+	}
+	if _, err := NewMarkovDB(store, Options{Order: 2, Tokenizer: "unicode"}); err == nil {
+		t.Fatal("opened a database with the wrong tokenizer")
+	}
+
+	mdb, err = NewMarkovDB(NewMemoryStore(), Options{Order: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb.ReadSentence("Ciao!")
+	mdb.ReadSentence("ciao, mondo")
+	if follows, _ := mdb.GetFollows([]byte(`["ciao"]`)); len(follows) != 2 || follows.Total() != 2 {
+		t.Fatalf("follows of ciao = %v", follows)
+	}
+}
+
+// The legacy import must use the keys of the tokenizer of the database.
+func TestReadStdin(t *testing.T) {
+	file, err := ioutil.TempFile("", "dulbecco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("[\"Ciao\",\"Mondo\"]\nbello\n[\"ciao\",\"mondo\"]\nlindo\n")
+	file.Seek(0, 0)
+	stdin := os.Stdin
+	os.Stdin = file
+	defer func() { os.Stdin = stdin }()
+
+	mdb, err := NewMarkovDB(NewMemoryStore(), Options{Order: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ReadStdin(mdb)
+	if follows, _ := mdb.GetFollows([]byte(`["ciao","mondo"]`)); len(follows) != 2 || follows.Total() != 2 {
+		t.Fatalf("follows of ciao mondo = %v", follows)
+	}
+}
+
+// The bulk trainer must write the same data as ReadSentence.
+func TestBulkTrainer(t *testing.T) {
+	sentences := []string{"the cat sat", "a cat ran", "the cat sat on the mat", "the cat sat"}
+	opts := Options{Order: 2, MinOrder: 1}
+	expected, err := NewMarkovDB(NewMemoryStore(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb, err := NewMarkovDB(NewMemoryStore(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulk := mdb.NewBulkTrainer()
+	for i, sentence := range sentences {
+		expected.ReadSentence(sentence)
+		bulk.Add(sentence, Source{})
+		// flushing halfway merges with what is already stored
+		if i == 1 {
+			if err := bulk.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := bulk.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := dump(mdb.Store()), dump(expected.Store()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("bulk training wrote\n%v\nexpected\n%v", got, want)
+	}
+	if bulk.Sentences != len(sentences) {
+		t.Fatalf("Sentences = %d, expected %d", bulk.Sentences, len(sentences))
+	}
+}
+
+func dump(store Store) map[string]string {
+	data := make(map[string]string)
+	store.Iterate(nil, func(key, value []byte) error {
+		data[string(key)] = string(value)
+		return nil
+	})
+	return data
+}
+
+func TestExportImport(t *testing.T) {
+	opts := Options{Order: 2, MinOrder: 1}
+	src, err := NewMarkovDB(NewMemoryStore(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.ReadSentence("the cat sat")
+	src.ReadSentence("the \"cat\" <ran>")
+
+	var buf bytes.Buffer
+	if _, err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	export := buf.String()
+
+	dst, err := NewMarkovDB(NewMemoryStore(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importString := func(s string) {
+		r := bufio.NewReader(strings.NewReader(s))
+		header, err := ReadExportHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dst.Import(header, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	importString(export)
+	if got, want := dump(dst.Store()), dump(src.Store()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("imported\n%v\nexpected\n%v", got, want)
+	}
+
+	// importing again adds the counts
+	importString(export)
+	src.ReadSentence("the cat sat")
+	src.ReadSentence("the \"cat\" <ran>")
+	if got, want := dump(dst.Store()), dump(src.Store()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("merged\n%v\nexpected\n%v", got, want)
+	}
+
+	other, err := NewMarkovDB(NewMemoryStore(), Options{Order: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(strings.NewReader(export))
+	header, _ := ReadExportHeader(r)
+	if _, err := other.Import(header, r); err == nil {
+		t.Fatal("imported an export with a different order")
+	}
+}
+
+func TestForget(t *testing.T) {
+	opts := Options{Order: 2, MinOrder: 1, Provenance: true}
+	mdb, err := NewMarkovDB(NewMemoryStore(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := NewMarkovDB(NewMemoryStore(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulk := mdb.NewBulkTrainer()
+	bulk.Add("the cat sat", Source{"Troll", "#a"})
+	if err := bulk.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	mdb.Learn("the cat ran", Source{"troll", "#b"})
+	mdb.Learn("the cat sat", Source{"sand", "#a"})
+	expected.Learn("the cat sat", Source{"sand", "#a"})
+
+	// only in #b
+	if _, err := mdb.Forget("TROLL", "#b"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := mdb.WordCount("ran"); count != 0 {
+		t.Fatalf("WordCount(ran) = %d after forgetting #b", count)
+	}
+	if count, _ := mdb.WordCount("cat"); count != 2 {
+		t.Fatalf("WordCount(cat) = %d, expected 2", count)
+	}
+
+	if _, err := mdb.Forget("troll", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dump(mdb.Store()), dump(expected.Store()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after Forget\n%v\nexpected\n%v", got, want)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	mdb, err := NewMarkovDB(NewMemoryStore(), Options{Order: 2, Provenance: true, Blocklist: []string{"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb.Learn("my password is hunter2 ok", Source{"sand", "#a"})
+	mdb.Learn("the cat sat", Source{"sand", "#a"})
+	mdb.Learn("the secret is out", Source{"sand", "#a"})
+	if count, _ := mdb.WordCount("secret"); count != 0 {
+		t.Fatal("learned a blocked sentence")
+	}
+
+	n, err := mdb.Purge(regexp.MustCompile(`password is \S+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "password is" followed by "hunter2", and "is hunter2" preceded by
+	// "password"; their provenance is not counted
+	if n != 2 {
+		t.Fatalf("Purge removed %d transitions, expected 2", n)
+	}
+	if n, err = mdb.Purge(regexp.MustCompile(`hunter2`)); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range dump(mdb.Store()) {
+		if strings.Contains(key+value, "hunter2") {
+			t.Errorf("%q: %q not purged", key, value)
+		}
+	}
+	// 8 words were learned, and "hunter2" is gone
+	if total, _ := mdb.TotalWords(); total != 7 {
+		t.Fatalf("TotalWords() = %d, expected 7", total)
+	}
+	if word, err := mdb.next([]string{"the", "cat"}); err != nil || word != "sat" {
+		t.Fatalf("next(the cat) = %q, %v", word, err)
+	}
+}
+
+func TestStatsExplain(t *testing.T) {
+	mdb, err := NewMarkovDB(NewMemoryStore(), Options{Order: 2, MinOrder: 1, Provenance: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb.Learn("the cat sat", Source{"sand", "#a"})
+	mdb.Learn("the cat ran", Source{"pinolo", "#a"})
+
+	stats, err := mdb.Stats(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "the", "cat", "sat", "ran", "the cat", "cat sat", "cat ran"
+	if stats.States != 7 || stats.Transitions != 9 || stats.Words != 4 || stats.TotalWords != 6 || stats.Contributors != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(stats.TopWords) != 1 || stats.TopWords[0] != (Follow{"cat", 2}) {
+		t.Fatalf("TopWords = %v", stats.TopWords)
+	}
+
+	seed, steps, err := mdb.Explain("the cat ran away")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Step{
+		{[]string{"the"}, "cat", 2, 2},
+		{[]string{"the", "cat"}, "ran", 1, 2},
+		{[]string{"cat", "ran"}, "away", 0, 1},
+		{[]string{"ran", "away"}, "\n", 0, 0},
+	}
+	if !reflect.DeepEqual(seed, []string{"the"}) || !reflect.DeepEqual(steps, expected) {
+		t.Fatalf("Explain = %v, %v", seed, steps)
+	}
+}
+
+func TestCorpora(t *testing.T) {
+	corpora, err := NewCorpora(NewMemoryStore(), Options{Order: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, err := corpora.Get("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpora.Default().ReadSentence("the cat")
+	for i := 0; i < 3; i++ {
+		work.ReadSentence("the deadline")
+	}
+
+	if _, err := corpora.Lookup("wrok"); err == nil {
+		t.Fatal("Lookup() found a corpus never created")
+	}
+	if mdb, err := corpora.Lookup("work"); err != nil || mdb != work {
+		t.Fatalf("Lookup(work) = %v, %v", mdb, err)
+	}
+	if names, err := corpora.Names(); err != nil || !reflect.DeepEqual(names, []string{"work"}) {
+		t.Fatalf("Names() = %v, %v", names, err)
+	}
+	if count, _ := corpora.Default().WordCount("deadline"); count != 0 {
+		t.Fatal("the default corpus learned from work")
+	}
+	var buf bytes.Buffer
+	corpora.Default().Export(&buf)
+	if strings.Contains(buf.String(), "deadline") {
+		t.Fatalf("the export of the default corpus contains work:\n%s", buf.String())
+	}
+
+	// the probabilities of each corpus are mixed, no matter how much they
+	// learned
+	blend, err := corpora.Blend(map[string]float64{"default": 1, "work": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	follows, err := blend.GetFollows([]byte(`["the"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Follows{{"cat", 500}, {"deadline", 500}}
+	if !reflect.DeepEqual(follows, expected) {
+		t.Fatalf("blended follows %v, expected %v", follows, expected)
+	}
+	if count, _ := blend.WordCount("the"); count != 4 {
+		t.Fatalf("blended WordCount(the) = %d, expected 4", count)
+	}
+	if reply := blend.GenerateReply("deadline", nil); reply != "the deadline" {
+		t.Fatalf("blended reply %q", reply)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	corpus := []string{
+		"my dog is nice",
+		"my dog likes long walks in the park",
+		"the park is nice in the morning",
+		"I think the weather is nice today",
+		"the weather is bad in the morning",
+	}
+	generate := func() []string {
+		opts := Options{Order: 2, MinOrder: 1, Rand: rand.NewSource(1)}
+		opts.Scoring = DefaultScoring
+		opts.Scoring.Budget = time.Minute
+		mdb, err := NewMarkovDB(NewMemoryStore(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sentence := range corpus {
+			mdb.ReadSentence(sentence)
+		}
+		return []string{
+			mdb.Goo([]string{"my", "dog"}),
+			mdb.Goo([]string{"the", "weather"}),
+			mdb.Generate("what about the park?"),
+			mdb.Generate("the morning"),
+			mdb.GenerateReply("nice walks", []string{"my dog likes long walks in the park"}),
+		}
+	}
+
+	golden := []string{
+		"my dog likes long walks in the morning",
+		"the weather is nice",
+		"the park is nice today",
+		"my dog likes long walks in the morning",
+		"I think the weather is nice today",
+	}
+	result := generate()
+	if !reflect.DeepEqual(result, golden) {
+		t.Errorf("generated %q, expected %q", result, golden)
+	}
+	// the same seed gives the same output
+	if again := generate(); !reflect.DeepEqual(again, result) {
+		t.Errorf("generated %q, then %q", result, again)
+	}
+}
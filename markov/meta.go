@@ -0,0 +1,216 @@
+package markov
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// Metadata keys start with a NUL byte, so they can't be confused with the
+// JSON encoded ngrams.
+const metaPrefix = "\x00meta:"
+
+const (
+	// version of the format of the stored values
+	metaFormat = "format"
+	// the lengths of the ngrams, see Options
+	metaOrder    = "order"
+	metaMinOrder = "min_order"
+	// the name of the tokenizer
+	metaTokenizer = "tokenizer"
+
+	// [[word, count], ...] follow lists, see Follows
+	formatCounts = "2"
+)
+
+func metaKey(name string) []byte {
+	return []byte(metaPrefix + name)
+}
+
+func isMetaKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(metaPrefix))
+}
+
+// Returns the value of a metadata entry, or "" if it's not set.
+func (mdb *MarkovDB) GetMeta(name string) (string, error) {
+	value, err := mdb.store.Get(metaKey(name))
+	return string(value), err
+}
+
+func (mdb *MarkovDB) SetMeta(name, value string) error {
+	return mdb.store.Put(metaKey(name), []byte(value))
+}
+
+// Returns true if the store contains no ngrams.
+func (mdb *MarkovDB) isEmpty() (bool, error) {
+	empty := true
+	err := mdb.store.Iterate(nil, func(key, value []byte) error {
+		if isMetaKey(key) {
+			return nil
+		}
+		empty = false
+		return ErrStopIteration
+	})
+	return empty, err
+}
+
+// Bring a database written by an older version up to date; new databases
+// are just marked with the current format.
+func (mdb *MarkovDB) upgrade() error {
+	format, err := mdb.GetMeta(metaFormat)
+	if err != nil || format == formatCounts {
+		return err
+	}
+
+	empty, err := mdb.isEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		log.Print("Converting the markov database to the weighted format, this may take a while")
+		n, err := mdb.convertFollows()
+		if err != nil {
+			return err
+		}
+		log.Printf("Converted %d ngrams", n)
+	}
+	return mdb.SetMeta(metaFormat, formatCounts)
+}
+
+// Number of values rewritten by each batch of convertFollows.
+const convertBatchSize = 10000
+
+// Rewrite every list of words as a list of [word, 1] pairs. Stores can't be
+// written while iterating, so the conversion is done in batches, each one
+// starting after the last key converted.
+func (mdb *MarkovDB) convertFollows() (int, error) {
+	var count int
+	var next []byte
+	for {
+		batch := mdb.store.NewBatch()
+		err := mdb.store.IterateFrom(nil, next, func(key, value []byte) error {
+			if isMetaKey(key) {
+				return nil
+			}
+			follows, err := decodeFollows(value)
+			if err != nil {
+				return err
+			}
+			data, err := follows.MarshalJSON()
+			if err != nil {
+				return err
+			}
+			batch.Put(key, data)
+			if batch.Len() >= convertBatchSize {
+				next = keyAfter(key)
+				return ErrStopIteration
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+
+		n := batch.Len()
+		if err := batch.Write(); err != nil {
+			return count, err
+		}
+		count += n
+		if n < convertBatchSize {
+			return count, nil
+		}
+	}
+}
+
+// Save the order of a new database, or compare it with the configured one.
+func (mdb *MarkovDB) checkOrder() error {
+	order, err := mdb.GetMeta(metaOrder)
+	if err != nil {
+		return err
+	}
+	minOrder, err := mdb.GetMeta(metaMinOrder)
+	if err != nil {
+		return err
+	}
+
+	if order == "" {
+		// a new database, or one written before the order was saved: older
+		// versions only knew about a single order.
+		n, err := mdb.detectOrder()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = mdb.Order
+			minOrder = strconv.Itoa(mdb.MinOrder)
+		} else {
+			minOrder = strconv.Itoa(n)
+		}
+		order = strconv.Itoa(n)
+		if err := mdb.SetMeta(metaOrder, order); err != nil {
+			return err
+		}
+		if err := mdb.SetMeta(metaMinOrder, minOrder); err != nil {
+			return err
+		}
+	}
+
+	if order != strconv.Itoa(mdb.Order) || minOrder != strconv.Itoa(mdb.MinOrder) {
+		return fmt.Errorf("the markov database has order %s and min_order %s, but order %d and min_order %d are configured",
+			order, minOrder, mdb.Order, mdb.MinOrder)
+	}
+	return nil
+}
+
+// Returns the length of the first ngram found in the database, or 0 if it's
+// empty.
+func (mdb *MarkovDB) detectOrder() (int, error) {
+	var order int
+	err := mdb.store.Iterate([]byte("["), func(key, value []byte) error {
+		var ngram []string
+		if err := json.Unmarshal(key, &ngram); err != nil {
+			return err
+		}
+		order = len(ngram)
+		return ErrStopIteration
+	})
+	return order, err
+}
+
+// Set up the tokenizer saved in the database, checking that it's the one
+// requested (if any); new databases save the requested one.
+func (mdb *MarkovDB) checkTokenizer(requested string) error {
+	name, err := mdb.GetMeta(metaTokenizer)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		empty, err := mdb.isEmpty()
+		if err != nil {
+			return err
+		}
+		if !empty {
+			// written before tokenizers were configurable
+			name = "fields"
+		} else if requested != "" {
+			name = requested
+		} else {
+			name = DefaultTokenizer
+		}
+		if _, err := getTokenizer(name); err != nil {
+			return err
+		}
+		if err := mdb.SetMeta(metaTokenizer, name); err != nil {
+			return err
+		}
+	}
+
+	if requested != "" && requested != name {
+		return fmt.Errorf("the markov database uses the %q tokenizer, but %q is configured", name, requested)
+	}
+	mdb.Tokenizer, err = getTokenizer(name)
+	return err
+}
@@ -0,0 +1,53 @@
+package markov
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// lockedSource makes a rand.Source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// globalSource draws from the global source of math/rand.
+type globalSource struct{}
+
+func (globalSource) Int63() int64 {
+	return rand.Int63()
+}
+
+// Seed does nothing: the global source is seeded by the program.
+func (globalSource) Seed(seed int64) {}
+
+// Returns a source safe for concurrent use drawing from src, or from the
+// global source of math/rand if src is nil.
+func lockSource(src rand.Source) rand.Source {
+	switch src.(type) {
+	case nil:
+		return globalSource{}
+	case *lockedSource, globalSource:
+		return src
+	}
+	return &lockedSource{src: src}
+}
+
+// Returns a Rand safe for concurrent use drawing from src, or from the global
+// source of math/rand if src is nil; with a seeded source, i.e.
+// rand.NewSource(1), the same choices are made every time.
+func NewRand(src rand.Source) *rand.Rand {
+	return rand.New(lockSource(src))
+}
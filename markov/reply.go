@@ -0,0 +1,194 @@
+package markov
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// How replies are chosen: up to Candidates phrases are generated within
+// Budget, and the one with the highest score is returned. The score of a
+// phrase is
+//
+//	Surprise * information - Overlap * overlap - Repeat * repetition
+//
+// where information is the sum of the surprise (-log2 of the frequency) of
+// the input keywords it contains, overlap is the fraction of its words found
+// in the input and repetition is its similarity (0-1) with the most similar
+// recent output of the bot.
+type Scoring struct {
+	Candidates int
+	Budget     time.Duration
+	Surprise   float64
+	Overlap    float64
+	Repeat     float64
+}
+
+var DefaultScoring = Scoring{
+	Candidates: 10,
+	Budget:     200 * time.Millisecond,
+	Surprise:   1,
+	Overlap:    5,
+	Repeat:     10,
+}
+
+func (s Scoring) withDefaults() Scoring {
+	if s == (Scoring{}) {
+		return DefaultScoring
+	}
+	if s.Candidates <= 0 {
+		s.Candidates = DefaultScoring.Candidates
+	}
+	if s.Budget <= 0 {
+		s.Budget = DefaultScoring.Budget
+	}
+	return s
+}
+
+// Generate a reply to seed; see GenerateReply.
+func (mdb *MarkovDB) Generate(seed string) string {
+	return mdb.GenerateReply(seed, nil)
+}
+
+// Generate a reply to input, avoiding the phrases in recent (the latest
+// outputs of the bot), as described in Scoring; returns "" if nothing could
+// be generated.
+func (mdb *MarkovDB) GenerateReply(input string, recent []string) string {
+	words := mdb.Tokenizer.Tokenize(input)
+	keywords := mdb.keywords(words)
+	deadline := time.Now().Add(mdb.Scoring.Budget)
+
+	var best string
+	bestScore := math.Inf(-1)
+	for i := 0; i < mdb.Scoring.Candidates; i++ {
+		if i > 0 && time.Now().After(deadline) {
+			break
+		}
+		candidate := mdb.candidate(words, keywords, i)
+		if candidate == "" || candidate == input || candidate == mdb.Tokenizer.Join(words) {
+			continue
+		}
+		if score := mdb.score(candidate, words, keywords, recent); score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
+
+// Generate the i-th candidate reply: the first one is about the rarest
+// keyword, the others about random keywords; without keywords the input
+// itself is continued.
+func (mdb *MarkovDB) candidate(words []string, keywords map[string]int, i int) string {
+	if len(keywords) > 0 {
+		keyword := mdb.keyword(keywords)
+		if i > 0 {
+			keyword = randomKey(mdb.rand, keywords)
+		}
+		if phrase := mdb.around(keyword); phrase != "" {
+			return phrase
+		}
+	}
+	return mdb.continueInput(words)
+}
+
+// Continue the input from one of its ngrams chosen at random.
+func (mdb *MarkovDB) continueInput(words []string) string {
+	// use the longest ngrams the input is long enough for
+	order := mdb.Order
+	if len(words) < order && len(words) >= mdb.MinOrder {
+		order = len(words)
+	}
+	if len(words) < order {
+		return ""
+	}
+	start := mdb.rand.Intn(len(words) - order + 1)
+	ngram := append([]string(nil), words[start:start+order]...)
+	return mdb.Goo(ngram)
+}
+
+// Returns a key of m drawn from r; the keys are sorted first, because the
+// order of the map is random.
+func randomKey(r *rand.Rand, m map[string]int) string {
+	if len(m) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys[r.Intn(len(keys))]
+}
+
+func (mdb *MarkovDB) score(candidate string, input []string, keywords map[string]int, recent []string) float64 {
+	words := normalize(mdb.Tokenizer, mdb.Tokenizer.Tokenize(candidate))
+	input = normalize(mdb.Tokenizer, input)
+	total, _ := mdb.TotalWords()
+
+	// the information carried by the keywords of the input used in the reply
+	var information float64
+	if total > 0 {
+		for _, word := range words {
+			if count, ok := keywords[word]; ok {
+				information -= math.Log2(float64(count) / float64(total))
+			}
+		}
+	}
+	// don't reward long replies just for repeating the keywords (MegaHAL)
+	if len(words) > 8 {
+		information /= math.Sqrt(float64(len(words) - 1))
+	}
+	if len(words) > 16 {
+		information /= float64(len(words))
+	}
+
+	var repetition float64
+	for _, phrase := range recent {
+		if sim := similarity(words, normalize(mdb.Tokenizer, mdb.Tokenizer.Tokenize(phrase))); sim > repetition {
+			repetition = sim
+		}
+	}
+
+	s := mdb.Scoring
+	return s.Surprise*information - s.Overlap*overlap(words, input) - s.Repeat*repetition
+}
+
+// Returns the fraction of words found in other.
+func overlap(words, other []string) float64 {
+	if len(words) == 0 {
+		return 0
+	}
+	set := wordSet(other)
+	var n int
+	for _, word := range words {
+		if set[word] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(words))
+}
+
+// Returns the Jaccard similarity of the sets of words of a and b.
+func similarity(a, b []string) float64 {
+	setA, setB := wordSet(a), wordSet(b)
+	var common int
+	for word := range setA {
+		if setB[word] {
+			common++
+		}
+	}
+	union := len(setA) + len(setB) - common
+	if union == 0 {
+		return 0
+	}
+	return float64(common) / float64(union)
+}
+
+func wordSet(words []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range words {
+		set[word] = true
+	}
+	return set
+}
@@ -0,0 +1,179 @@
+package markov
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Statistics about a corpus, see MarkovDB.Stats.
+type Stats struct {
+	Order     int
+	MinOrder  int
+	Tokenizer string
+	// the forward ngrams, i.e. the states of the chain, and the distinct
+	// words following them
+	States      int
+	Transitions int
+	// the average number of distinct words following a state
+	Branching float64
+	// distinct words, and the total number of words learned
+	Words      int
+	TotalWords int
+	// nicks whose contributions are recorded, see Source
+	Contributors int
+	// the most common words, stopwords excluded
+	TopWords []Follow
+	// approximate size on disk, or -1 if the store can't tell
+	Size int64
+}
+
+// Returns the statistics of the corpus, with its top most common words.
+// Every key of the store is read, so it can take a while.
+func (mdb *MarkovDB) Stats(top int) (*Stats, error) {
+	tokenizer, err := mdb.GetMeta(metaTokenizer)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{
+		Order:     mdb.Order,
+		MinOrder:  mdb.MinOrder,
+		Tokenizer: tokenizer,
+		Size:      -1,
+	}
+	if stats.TotalWords, err = mdb.TotalWords(); err != nil {
+		return nil, err
+	}
+
+	var words []Follow
+	var lastNick []byte
+	err = mdb.store.Iterate(nil, func(key, value []byte) error {
+		switch {
+		case len(key) == 0 || isMetaKey(key):
+		case key[0] == '[':
+			follows, err := decodeFollows(value)
+			if err != nil {
+				return err
+			}
+			stats.States++
+			stats.Transitions += len(follows)
+		case bytes.HasPrefix(key, []byte(wordPrefix)):
+			stats.Words++
+			word := string(key[len(wordPrefix):])
+			if mdb.isStopword(word) {
+				return nil
+			}
+			count, err := strconv.Atoi(string(value))
+			if err != nil {
+				return err
+			}
+			words = append(words, Follow{word, count})
+		case bytes.HasPrefix(key, []byte(provenancePrefix)):
+			// the keys are sorted, so the ones of each nick are together
+			nick := key[:bytes.IndexByte(key, 0)+1]
+			if !bytes.Equal(nick, lastNick) {
+				stats.Contributors++
+				lastNick = append(lastNick[:0], nick...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.States > 0 {
+		stats.Branching = float64(stats.Transitions) / float64(stats.States)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if words[i].Count != words[j].Count {
+			return words[i].Count > words[j].Count
+		}
+		return words[i].Word < words[j].Word
+	})
+	if len(words) > top {
+		words = words[:top]
+	}
+	stats.TopWords = words
+	if sizer, ok := mdb.store.(Sizer); ok {
+		if stats.Size, err = sizer.Size(); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// A transition of a sentence, see Explain.
+type Step struct {
+	// the words the following one was chosen after: from MinOrder to Order
+	// of them, depending on the back off
+	Context []string
+	// the following word, "\n" for the end of the sentence
+	Word string
+	// the occurrences of Word after Context and of all the words following
+	// it; Count is 0 if the transition was never learned
+	Count int
+	Total int
+}
+
+func (s Step) String() string {
+	word := s.Word
+	if word == "\n" {
+		word = "[end]"
+	}
+	if s.Count == 0 {
+		return fmt.Sprintf("%s -> %s (never seen)", strings.Join(s.Context, " "), word)
+	}
+	return fmt.Sprintf("%s -> %s (%d/%d)", strings.Join(s.Context, " "), word, s.Count, s.Total)
+}
+
+// Explain how sentence, i.e. a reply, can be generated: the first MinOrder
+// words are the seed, and every following word is a Step, including the end
+// of the sentence.
+func (mdb *MarkovDB) Explain(sentence string) (seed []string, steps []Step, err error) {
+	words := mdb.Tokenizer.Tokenize(sentence)
+	if len(words) < mdb.MinOrder {
+		return words, nil, nil
+	}
+	words = append(words, "\n")
+
+	for i := mdb.MinOrder; i < len(words); i++ {
+		step, err := mdb.explainStep(words[:i], words[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		steps = append(steps, step)
+	}
+	return words[:mdb.MinOrder], steps, nil
+}
+
+// Find the longest context before word that was followed by it.
+func (mdb *MarkovDB) explainStep(before []string, word string) (Step, error) {
+	n := mdb.Order
+	if len(before) < n {
+		n = len(before)
+	}
+	var unknown Step
+	for ; n >= mdb.MinOrder; n-- {
+		context := before[len(before)-n:]
+		key, err := makePrefixedKey(forwardPrefix, normalize(mdb.Tokenizer, context))
+		if err != nil {
+			return Step{}, err
+		}
+		follows, err := mdb.GetFollows(key)
+		if err != nil {
+			return Step{}, err
+		}
+		if unknown.Context == nil {
+			unknown = Step{Context: context, Word: word, Total: follows.Total()}
+		}
+		for _, follow := range follows {
+			if follow.Word == word || mdb.Tokenizer.Normalize(follow.Word) == mdb.Tokenizer.Normalize(word) {
+				return Step{context, word, follow.Count, follows.Total()}, nil
+			}
+		}
+	}
+	return unknown, nil
+}
@@ -0,0 +1,133 @@
+package markov
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Returned by an Iterate callback to stop the iteration without an error.
+var ErrStopIteration = errors.New("stop iteration")
+
+// A Store is an ordered key/value store holding a markov corpus; keys and
+// values are opaque to the store.
+type Store interface {
+	// Get returns nil if key doesn't exist.
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Iterate calls fn, in key order, for every key starting with prefix (an
+	// empty prefix matches every key) until fn returns an error. fn must not
+	// write to the store and must copy key and value to keep them.
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+	// IterateFrom is Iterate starting from the first key not less than
+	// start; a nil start is the same as Iterate.
+	IterateFrom(prefix, start []byte, fn func(key, value []byte) error) error
+	NewBatch() Batch
+	Close() error
+}
+
+// Returns the key to pass to IterateFrom to continue an iteration after key.
+func keyAfter(key []byte) []byte {
+	return append(append([]byte(nil), key...), 0)
+}
+
+// Returns where an iteration of the keys starting with prefix, from start,
+// begins.
+func seekKey(prefix, start []byte) []byte {
+	if bytes.Compare(start, prefix) > 0 {
+		return start
+	}
+	return prefix
+}
+
+// A Batch collects writes to be applied all at once by Write.
+type Batch interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+	// the number of writes in the batch
+	Len() int
+	Write() error
+}
+
+// Sizer is implemented by stores able to tell their (approximate) size on
+// disk.
+type Sizer interface {
+	Size() (int64, error)
+}
+
+// An Opener opens, creating it if needed, the store found at path.
+type Opener func(path string) (Store, error)
+
+var (
+	backends   = make(map[string]Opener)
+	backendsMu sync.Mutex
+)
+
+// RegisterBackend makes a store backend available by name; it's meant to be
+// called from init().
+func RegisterBackend(name string, opener Opener) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, dup := backends[name]; dup {
+		panic("markov: backend registered twice: " + name)
+	}
+	backends[name] = opener
+}
+
+// Returns the sorted names of the available backends.
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open the store at path with the named backend.
+func OpenStore(backend, path string) (Store, error) {
+	if backend == "" {
+		backend = DefaultBackend
+	}
+	backendsMu.Lock()
+	opener, ok := backends[backend]
+	backendsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown markov backend %q (available: %s)", backend, strings.Join(Backends(), ", "))
+	}
+	return opener(path)
+}
+
+// Number of writes after which Copy flushes its batch.
+const copyBatchSize = 1000
+
+// Copy all the keys of src to dst, returning the number of keys copied.
+func Copy(dst, src Store) (int, error) {
+	var count int
+	batch := dst.NewBatch()
+	err := src.Iterate(nil, func(key, value []byte) error {
+		batch.Put(append([]byte(nil), key...), append([]byte(nil), value...))
+		count++
+		if batch.Len() >= copyBatchSize {
+			// writing to dst while iterating src is fine, they're different stores
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch = dst.NewBatch()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := batch.Write(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
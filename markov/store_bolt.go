@@ -0,0 +1,143 @@
+package markov
+
+import (
+	"bytes"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// BoltDB is pure Go, so this backend is always available.
+func init() {
+	RegisterBackend("bolt", func(path string) (Store, error) {
+		return OpenBoltStore(path)
+	})
+}
+
+// All the keys are stored in a single bucket.
+var boltBucket = []byte("markov")
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	// fail instead of waiting forever if another process has the file open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// values are only valid during the transaction
+		if v := tx.Bucket(boltBucket).Get(key); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltStore) Put(key, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (s *BoltStore) Delete(key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(key)
+	})
+}
+
+func (s *BoltStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return s.IterateFrom(prefix, nil, fn)
+}
+
+func (s *BoltStore) IterateFrom(prefix, start []byte, fn func(key, value []byte) error) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek(seekKey(prefix, start)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+func (s *BoltStore) NewBatch() Batch {
+	return &boltBatch{store: s}
+}
+
+// Size returns the size of the database file.
+func (s *BoltStore) Size() (int64, error) {
+	var size int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltOp struct {
+	key, value []byte
+	delete     bool
+}
+
+// A bolt write transaction is only open while the batch is written.
+type boltBatch struct {
+	store *BoltStore
+	ops   []boltOp
+}
+
+func (b *boltBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, boltOp{key: append([]byte(nil), key...), value: append([]byte(nil), value...)})
+}
+
+func (b *boltBatch) Delete(key []byte) {
+	b.ops = append(b.ops, boltOp{key: append([]byte(nil), key...), delete: true})
+}
+
+func (b *boltBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *boltBatch) Write() error {
+	err := b.store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, op := range b.ops {
+			var err error
+			if op.delete {
+				err = bucket.Delete(op.key)
+			} else {
+				err = bucket.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	b.ops = nil
+	return err
+}
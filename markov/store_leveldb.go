@@ -0,0 +1,129 @@
+//go:build !noleveldb
+// +build !noleveldb
+
+package markov
+
+import (
+	"bytes"
+	"github.com/jmhodges/levigo"
+)
+
+// The LevelDB backend needs cgo and the LevelDB C library; build with the
+// "noleveldb" tag to leave it out.
+func init() {
+	RegisterBackend("leveldb", func(path string) (Store, error) {
+		return OpenLevelDBStore(path)
+	})
+}
+
+// The backend used when none is configured.
+const DefaultBackend = "leveldb"
+
+type LevelDBStore struct {
+	db    *levigo.DB
+	cache *levigo.Cache
+	ro    *levigo.ReadOptions
+	wo    *levigo.WriteOptions
+}
+
+func OpenLevelDBStore(path string) (*LevelDBStore, error) {
+	cache := levigo.NewLRUCache(3 << 29)
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCache(cache)
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(path, opts)
+	if err != nil {
+		cache.Close()
+		return nil, err
+	}
+
+	return &LevelDBStore{
+		db:    db,
+		cache: cache,
+		ro:    levigo.NewReadOptions(),
+		wo:    levigo.NewWriteOptions(),
+	}, nil
+}
+
+func (s *LevelDBStore) Get(key []byte) ([]byte, error) {
+	return s.db.Get(s.ro, key)
+}
+
+func (s *LevelDBStore) Put(key, value []byte) error {
+	return s.db.Put(s.wo, key, value)
+}
+
+func (s *LevelDBStore) Delete(key []byte) error {
+	return s.db.Delete(s.wo, key)
+}
+
+func (s *LevelDBStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return s.IterateFrom(prefix, nil, fn)
+}
+
+func (s *LevelDBStore) IterateFrom(prefix, start []byte, fn func(key, value []byte) error) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	// don't fill the cache with a full scan
+	ro.SetFillCache(false)
+	it := s.db.NewIterator(ro)
+	defer it.Close()
+
+	for it.Seek(seekKey(prefix, start)); it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if err := fn(key, it.Value()); err != nil {
+			if err == ErrStopIteration {
+				return nil
+			}
+			return err
+		}
+	}
+	return it.GetError()
+}
+
+func (s *LevelDBStore) NewBatch() Batch {
+	return &levelDBBatch{store: s, wb: levigo.NewWriteBatch()}
+}
+
+// Size returns the approximate size of the whole database on disk.
+func (s *LevelDBStore) Size() (int64, error) {
+	sizes := s.db.GetApproximateSizes([]levigo.Range{{Start: []byte{}, Limit: []byte{0xff, 0xff, 0xff, 0xff}}})
+	return int64(sizes[0]), nil
+}
+
+func (s *LevelDBStore) Close() error {
+	s.ro.Close()
+	s.wo.Close()
+	s.db.Close()
+	s.cache.Close()
+	return nil
+}
+
+type levelDBBatch struct {
+	store *LevelDBStore
+	wb    *levigo.WriteBatch
+	n     int
+}
+
+func (b *levelDBBatch) Put(key, value []byte) {
+	b.wb.Put(key, value)
+	b.n++
+}
+
+func (b *levelDBBatch) Delete(key []byte) {
+	b.wb.Delete(key)
+	b.n++
+}
+
+func (b *levelDBBatch) Len() int {
+	return b.n
+}
+
+func (b *levelDBBatch) Write() error {
+	defer b.wb.Close()
+	return b.store.db.Write(b.store.wo, b.wb)
+}
@@ -0,0 +1,134 @@
+package markov
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterBackend("memory", func(path string) (Store, error) {
+		return NewMemoryStore(), nil
+	})
+}
+
+// MemoryStore keeps the whole corpus in memory; it's meant for tests and
+// experiments since nothing is ever written to disk.
+type MemoryStore struct {
+	data map[string][]byte
+	mu   sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if value, ok := s.data[string(key)]; ok {
+		return append([]byte(nil), value...), nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) Put(key, value []byte) error {
+	s.mu.Lock()
+	s.data[string(key)] = append([]byte(nil), value...)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Delete(key []byte) error {
+	s.mu.Lock()
+	delete(s.data, string(key))
+	s.mu.Unlock()
+	return nil
+}
+
+// Iterate works on a snapshot of the matching keys, so unlike the other
+// stores it's safe to write from fn.
+func (s *MemoryStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return s.IterateFrom(prefix, nil, fn)
+}
+
+func (s *MemoryStore) IterateFrom(prefix, start []byte, fn func(key, value []byte) error) error {
+	type pair struct {
+		key   string
+		value []byte
+	}
+	var pairs []pair
+	s.mu.RLock()
+	for key, value := range s.data {
+		if strings.HasPrefix(key, string(prefix)) && key >= string(start) {
+			pairs = append(pairs, pair{key, value})
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+
+	for _, p := range pairs {
+		if err := fn([]byte(p.key), p.value); err != nil {
+			if err == ErrStopIteration {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) NewBatch() Batch {
+	return &memoryBatch{store: s}
+}
+
+// Size returns the number of bytes used by keys and values.
+func (s *MemoryStore) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var size int64
+	for key, value := range s.data {
+		size += int64(len(key) + len(value))
+	}
+	return size, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+type memoryOp struct {
+	key, value []byte
+	delete     bool
+}
+
+type memoryBatch struct {
+	store *MemoryStore
+	ops   []memoryOp
+}
+
+func (b *memoryBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, memoryOp{key: append([]byte(nil), key...), value: append([]byte(nil), value...)})
+}
+
+func (b *memoryBatch) Delete(key []byte) {
+	b.ops = append(b.ops, memoryOp{key: append([]byte(nil), key...), delete: true})
+}
+
+func (b *memoryBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *memoryBatch) Write() error {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	for _, op := range b.ops {
+		if op.delete {
+			delete(b.store.data, string(op.key))
+		} else {
+			b.store.data[string(op.key)] = op.value
+		}
+	}
+	b.ops = nil
+	return nil
+}
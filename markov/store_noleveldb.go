@@ -0,0 +1,7 @@
+//go:build noleveldb
+// +build noleveldb
+
+package markov
+
+// Without LevelDB the pure Go bolt backend is used when none is configured.
+const DefaultBackend = "bolt"
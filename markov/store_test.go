@@ -0,0 +1,82 @@
+package markov
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testStore(t *testing.T, store Store) {
+	for _, key := range []string{"b", "a", "ab", "c"} {
+		if err := store.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := store.Get([]byte("ab")); err != nil || string(v) != "vab" {
+		t.Fatalf("Get(ab) = %q, %v", v, err)
+	}
+	if v, err := store.Get([]byte("missing")); err != nil || v != nil {
+		t.Fatalf("Get(missing) = %q, %v", v, err)
+	}
+
+	batch := store.NewBatch()
+	batch.Delete([]byte("c"))
+	batch.Put([]byte("aa"), []byte("vaa"))
+	if batch.Len() != 2 {
+		t.Fatalf("batch.Len() = %d", batch.Len())
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	store.Iterate([]byte("a"), func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if expected := []string{"a", "aa", "ab"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Iterate(a) = %q, expected %q", keys, expected)
+	}
+	keys = nil
+	store.IterateFrom([]byte("a"), keyAfter([]byte("a")), func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if expected := []string{"aa", "ab"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("IterateFrom(a, a\\x00) = %q, expected %q", keys, expected)
+	}
+
+	dst := NewMemoryStore()
+	if n, err := Copy(dst, store); err != nil || n != 4 {
+		t.Fatalf("Copy() = %d, %v", n, err)
+	}
+	keys = nil
+	dst.Iterate(nil, func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return ErrStopIteration
+	})
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("stopped Iterate() = %q", keys)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "markov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenStore("bolt", filepath.Join(dir, "markov.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testStore(t, store)
+}
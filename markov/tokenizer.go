@@ -0,0 +1,196 @@
+package markov
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A Tokenizer splits the text learned and generated by a MarkovDB.
+type Tokenizer interface {
+	// Tokenize returns the tokens of text as they are written.
+	Tokenize(text string) []string
+	// Normalize returns the form of token used in the database keys, so
+	// that i.e. "Ciao" and "ciao" are the same state.
+	Normalize(token string) string
+	// Join the tokens back into text.
+	Join(tokens []string) string
+}
+
+// The tokenizer of new databases; databases created before tokenizers were
+// configurable use "fields".
+const DefaultTokenizer = "unicode"
+
+var (
+	tokenizers   = make(map[string]Tokenizer)
+	tokenizersMu sync.Mutex
+)
+
+func init() {
+	RegisterTokenizer("fields", fieldsTokenizer{})
+	RegisterTokenizer("unicode", unicodeTokenizer{})
+}
+
+// RegisterTokenizer makes a tokenizer available by name; it's meant to be
+// called from init().
+func RegisterTokenizer(name string, tokenizer Tokenizer) {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+	if _, dup := tokenizers[name]; dup {
+		panic("markov: tokenizer registered twice: " + name)
+	}
+	tokenizers[name] = tokenizer
+}
+
+// Returns the sorted names of the available tokenizers.
+func Tokenizers() []string {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+	var names []string
+	for name := range tokenizers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getTokenizer(name string) (Tokenizer, error) {
+	tokenizersMu.Lock()
+	tokenizer, ok := tokenizers[name]
+	tokenizersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown markov tokenizer %q (available: %s)", name, strings.Join(Tokenizers(), ", "))
+	}
+	return tokenizer, nil
+}
+
+// Returns the normalized form of every token.
+func normalize(tokenizer Tokenizer, tokens []string) []string {
+	result := make([]string, len(tokens))
+	for i, token := range tokens {
+		result[i] = tokenizer.Normalize(token)
+	}
+	return result
+}
+
+// fieldsTokenizer splits on white space and keeps the words as they are, like
+// the first versions did.
+type fieldsTokenizer struct{}
+
+func (fieldsTokenizer) Tokenize(text string) []string {
+	return strings.Fields(text)
+}
+
+func (fieldsTokenizer) Normalize(token string) string {
+	return token
+}
+
+func (fieldsTokenizer) Join(tokens []string) string {
+	return strings.Join(tokens, " ")
+}
+
+var (
+	// mIRC formatting: bold, colors (^C<fg>,<bg> and ^D<hex>), reset,
+	// monospace, reverse, italic, strikethrough and underline
+	reFormatting = regexp.MustCompile("\x03(\\d{1,2}(,\\d{1,2})?)?|\x04([0-9a-fA-F]{6}(,[0-9a-fA-F]{6})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]")
+	reURL        = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+`)
+	// "nick: " at the beginning of a message; "nick, " is too common in
+	// normal sentences
+	reHighlight = regexp.MustCompile("^\\s*[A-Za-z\\[\\]\\\\`_^{|}][A-Za-z0-9\\[\\]\\\\`_^{|}-]*:\\s+")
+)
+
+// unicodeTokenizer splits words from punctuation, which is kept as separate
+// tokens (so "ciao!" is "ciao" followed by "!"), and ignores case. URLs, nick
+// highlights and mIRC formatting codes are removed.
+type unicodeTokenizer struct{}
+
+// Strip what should never be learned from text.
+func cleanText(text string) string {
+	text = reFormatting.ReplaceAllString(text, "")
+	text = reURL.ReplaceAllString(text, "")
+	text = reHighlight.ReplaceAllString(text, "")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+func isBracket(r rune) bool {
+	return strings.ContainsRune("()[]{}", r)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+func (unicodeTokenizer) Tokenize(text string) []string {
+	var tokens []string
+	runes := []rune(cleanText(text))
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case isWordRune(r):
+			// a word can contain apostrophes, hyphens and dots: "can't",
+			// "e-mail", "3.14"
+			for i < len(runes) && (isWordRune(runes[i]) ||
+				(strings.ContainsRune("'’-.", runes[i]) && i+1 < len(runes) && isWordRune(runes[i+1]))) {
+				i++
+			}
+		case isBracket(r):
+			i++
+		default:
+			// a run of punctuation and symbols: "!", "...", ":-)"; a bracket
+			// ends it, unless it's part of an emoticon
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !isWordRune(runes[i]) {
+				if isBracket(runes[i]) && !strings.ContainsAny(string(runes[start:i]), ":;=") {
+					break
+				}
+				i++
+			}
+		}
+		tokens = append(tokens, string(runes[start:i]))
+	}
+	return tokens
+}
+
+func (unicodeTokenizer) Normalize(token string) string {
+	return strings.ToLower(token)
+}
+
+// Tokens not preceded by a space.
+func isClosing(token string) bool {
+	if token == ")" || token == "]" || token == "}" {
+		return true
+	}
+	for _, r := range token {
+		if !strings.ContainsRune(".,;:!?…%", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Tokens not followed by a space.
+func isOpening(token string) bool {
+	return token == "(" || token == "[" || token == "{"
+}
+
+func (unicodeTokenizer) Join(tokens []string) string {
+	var buf strings.Builder
+	for i, token := range tokens {
+		if i > 0 && !isClosing(token) && !isOpening(tokens[i-1]) {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(token)
+	}
+	return buf.String()
+}
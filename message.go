@@ -54,6 +54,52 @@ func (m *Message) ReplyTarget() string {
 	return m.Nick
 }
 
+// Returns the channel an event refers to, or an empty string for private
+// messages and events not related to a channel (i.e. NICK).
+func (m *Message) Channel() string {
+	switch m.Cmd {
+	case "PRIVMSG", "NOTICE", "ACTION", "JOIN", "PART", "KICK", "TOPIC":
+		if m.IsFromChannel() {
+			return m.Args[0]
+		}
+	case "INVITE":
+		if len(m.Args) > 1 {
+			return m.Args[1]
+		}
+	case "NICK", "QUIT":
+	default:
+		// numeric replies: the first argument is our nickname
+		for i := 1; i < len(m.Args); i++ {
+			if isChannelName(m.Args[i]) {
+				return m.Args[i]
+			}
+		}
+	}
+	return ""
+}
+
+// Returns the "text" of an event: the message for PRIVMSG, NOTICE and ACTION,
+// the new topic for TOPIC, the reason for PART and KICK, the channel for JOIN
+// and INVITE, the new nickname for NICK and the last argument otherwise.
+func (m *Message) Text() string {
+	var i int
+
+	switch m.Cmd {
+	case "PRIVMSG", "NOTICE", "ACTION", "TOPIC", "PART":
+		i = 1
+	case "KICK":
+		i = 2
+	case "JOIN", "NICK":
+		i = 0
+	case "INVITE":
+		i = 1
+	default:
+		i = len(m.Args) - 1
+	}
+	text, _ := m.Arg(i)
+	return text
+}
+
 func (m *Message) Dump() string {
 	return fmt.Sprintf("%+v", m)
 }
@@ -61,13 +107,17 @@ func (m *Message) Dump() string {
 // Returns true if the Message generated inside a IRC channel
 //   Channel types: https://www.alien.net.au/irc/chantypes.html
 func (m *Message) IsFromChannel() bool {
-	if len(m.Args) > 0 && len(m.Args[0]) > 0 {
-		return strings.ContainsAny(string(m.Args[0][0]), "&#!+.~")
+	if len(m.Args) > 0 {
+		return isChannelName(m.Args[0])
 	}
 
 	return false
 }
 
+func isChannelName(name string) bool {
+	return len(name) > 0 && strings.ContainsAny(string(name[0]), "&#!+.~")
+}
+
 // Parse a line from the IRC server into a Message struct.
 func parseMessage(s string) (*Message, error) {
 	s = strings.TrimRight(s, "\r\n")
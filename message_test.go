@@ -0,0 +1,108 @@
+package dulbecco
+
+import (
+	"github.com/piger/dulbecco/markov"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMessageChannelText(t *testing.T) {
+	tests := []struct {
+		line    string
+		channel string
+		text    string
+	}{
+		{":sand!~sand@localhost PRIVMSG #pizza :hello world", "#pizza", "hello world"},
+		{":sand!~sand@localhost PRIVMSG pinolo :hello", "", "hello"},
+		{":sand!~sand@localhost NOTICE &local :notice", "&local", "notice"},
+		{":sand!~sand@localhost PRIVMSG #pizza :\x01ACTION waves\x01", "#pizza", "waves"},
+		{":sand!~sand@localhost JOIN :#pizza", "#pizza", "#pizza"},
+		{":sand!~sand@localhost PART #pizza :bye", "#pizza", "bye"},
+		{":sand!~sand@localhost PART #pizza", "#pizza", ""},
+		{":sand!~sand@localhost KICK #pizza troll :go away", "#pizza", "go away"},
+		{":sand!~sand@localhost TOPIC #pizza :margherita", "#pizza", "margherita"},
+		{":sand!~sand@localhost INVITE pinolo :#fun", "#fun", "#fun"},
+		{":sand!~sand@localhost NICK :sandro", "", "sandro"},
+		{":sand!~sand@localhost QUIT :Ping timeout", "", "Ping timeout"},
+		{":irc.example.org 332 pinolo #pizza :the topic", "#pizza", "the topic"},
+		{":irc.example.org 001 pinolo :Welcome", "", "Welcome"},
+		{"PING :irc.example.org", "", "irc.example.org"},
+	}
+
+	for _, test := range tests {
+		message, err := parseMessage(test.line)
+		if err != nil {
+			t.Errorf("parseMessage(%q): %s", test.line, err)
+			continue
+		}
+		if channel := message.Channel(); channel != test.channel {
+			t.Errorf("%q: Channel() = %q, expected %q", test.line, channel, test.channel)
+		}
+		if text := message.Text(); text != test.text {
+			t.Errorf("%q: Text() = %q, expected %q", test.line, text, test.text)
+		}
+	}
+}
+
+// A module recording the commands of the messages it handles.
+type recordingPlugin struct {
+	name     string
+	commands []string
+}
+
+func (p *recordingPlugin) Name() string        { return p.name }
+func (p *recordingPlugin) Init(bot *Bot) error { return nil }
+func (p *recordingPlugin) Shutdown()           {}
+func (p *recordingPlugin) Handle(event *Event) {
+	p.commands = append(p.commands, event.Message.Cmd+" "+event.Message.Channel())
+}
+
+func TestModuleDispatch(t *testing.T) {
+	filename := writeTempConfig(t, "config.toml", `
+[[server]]
+name = "local"
+address = "localhost:6667"
+nickname = "pinolo"
+username = "pinolo"
+realname = "Pinot di pinolo"
+channels = [ "#pizza", "#work" ]
+
+[server.channel."#work"]
+plugins = [ "hipchat" ]
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpora, err := markov.NewCorpora(markov.NewMemoryStore(), markov.Options{Order: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConnection(config.Servers[0], NewBot(config, corpora))
+	chat := &recordingPlugin{name: "markov"}
+	hipchat := &recordingPlugin{name: "hipchat"}
+	c.modules = []Plugin{chat, hipchat}
+
+	for _, line := range []string{
+		":sand!~sand@localhost PRIVMSG #pizza :hello",
+		":sand!~sand@localhost PRIVMSG #work :hello",
+		":sand!~sand@localhost JOIN :#work",
+		":sand!~sand@localhost PRIVMSG pinolo :hello",
+	} {
+		message, err := parseMessage(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.h_modules(message)
+	}
+
+	if expected := []string{"PRIVMSG #pizza", "PRIVMSG "}; !reflect.DeepEqual(chat.commands, expected) {
+		t.Errorf("markov handled %q, expected %q", chat.commands, expected)
+	}
+	if expected := []string{"PRIVMSG #pizza", "PRIVMSG #work", "JOIN #work", "PRIVMSG "}; !reflect.DeepEqual(hipchat.commands, expected) {
+		t.Errorf("hipchat handled %q, expected %q", hipchat.commands, expected)
+	}
+}
@@ -0,0 +1,79 @@
+package dulbecco
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Modules enabled on a server when ServerConfiguration.Modules is not set.
+var DefaultModules = []string{"markov"}
+
+// An Event is an IRC message received on a connection.
+type Event struct {
+	Conn    *Connection
+	Message *Message
+}
+
+// Plugin is the interface implemented by in-process plugins ("modules").
+//
+// Modules are compiled into the bot and register themselves with
+// RegisterPlugin, usually from an init() function; a single instance of
+// each enabled module is shared by all the connections, which only dispatch
+// events to the modules enabled in their configuration.
+type Plugin interface {
+	// the name used in the configuration file
+	Name() string
+	// called once when the bot starts, and on a new instance when its
+	// settings change on reload; a module returning an error is not enabled
+	Init(bot *Bot) error
+	// called for every IRC message received on a connection where the
+	// module is enabled
+	Handle(event *Event)
+	// called when the bot stops, when the module is no longer used or
+	// before restarting it on reload
+	Shutdown()
+}
+
+type PluginFactory func() Plugin
+
+var (
+	registry   = make(map[string]PluginFactory)
+	registryMu sync.Mutex
+)
+
+// Register a module; it panics if the same name is registered twice.
+func RegisterPlugin(name string, factory PluginFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, dup := registry[name]; dup {
+		panic("dulbecco: RegisterPlugin called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// Returns the names of all the registered modules.
+func RegisteredPlugins() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Create a new instance of a registered module.
+func newPlugin(name string) (Plugin, error) {
+	registryMu.Lock()
+	factory, ok := registry[name]
+	registryMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown module: %s", name)
+	}
+	return factory(), nil
+}
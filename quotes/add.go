@@ -1,6 +1,7 @@
 package quotes
 
 import (
+	"errors"
 	"fmt"
 	"github.com/codegangsta/cli"
 	"strconv"
@@ -18,27 +19,37 @@ func CmdAddQuote(ctx *cli.Context) {
 	}
 	quoteText := strings.Join(ctx.Args(), " ")
 
-	stmt, err := qdb.db.Prepare("INSERT INTO quotes(creation_date, author, quote, karma) VALUES (?, ?, ?, ?)")
+	id, err := qdb.AddQuote(author, quoteText)
 	if err != nil {
-		fmt.Printf("error preparing SQL query: %s", err)
+		fmt.Println(err)
 		return
 	}
+
+	fmt.Printf("Added quote %d\n", id)
+}
+
+// Add a new quote to the database and the index, returning its ID.
+func (q *QuotesDB) AddQuote(author, quoteText string) (int, error) {
+	stmt, err := q.db.Prepare("INSERT INTO quotes(creation_date, author, quote, karma) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return 0, fmt.Errorf("error preparing SQL query: %s", err)
+	}
 	defer stmt.Close()
 
 	result, err := stmt.Exec(time.Now(), author, quoteText, 0)
 	if err != nil {
-		fmt.Printf("error executing SQL query: %s", err)
-		return
+		return 0, fmt.Errorf("error executing SQL query: %s", err)
 	}
 	id, err := result.LastInsertId()
 	if err != nil {
-		fmt.Println("cannot get the inserted quote ID")
-		return
+		return 0, errors.New("cannot get the inserted quote ID")
 	}
 	strId := strconv.Itoa(int(id))
 
 	quote := &Quote{Id: int(id), Author: author, Quote: quoteText, Karma: 0}
-	qdb.idx.Index(strId, quote)
+	if err := q.idx.Index(strId, quote); err != nil {
+		return 0, fmt.Errorf("error indexing quote %d: %s", id, err)
+	}
 
-	fmt.Printf("Added quote %d\n", id)
+	return int(id), nil
 }
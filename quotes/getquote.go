@@ -14,7 +14,7 @@ func CmdGetQuote(ctx *cli.Context) {
 		fmt.Println("ma de che?")
 		return
 	}
-	quote, err := qdb.getQuote(id)
+	quote, err := qdb.GetQuote(id)
 	if err == sql.ErrNoRows {
 		fmt.Println("Te stai popo che a sbàja")
 		return
@@ -28,7 +28,7 @@ func CmdGetQuote(ctx *cli.Context) {
 func CmdGetRandomQuote(ctx *cli.Context) {
 	qdb := OpenQuotesDB(ctx)
 
-	quote, err := qdb.getRandomQuote()
+	quote, err := qdb.GetRandomQuote()
 	if err != nil {
 		fmt.Printf("error getting quote: %s\n", err)
 		return
@@ -36,7 +36,7 @@ func CmdGetRandomQuote(ctx *cli.Context) {
 	fmt.Printf("%d: %s\n", quote.Id, quote.Quote)
 }
 
-func (q *QuotesDB) getQuote(id string) (*Quote, error) {
+func (q *QuotesDB) GetQuote(id string) (*Quote, error) {
 	stmt, err := q.db.Prepare("SELECT id, author, quote, karma FROM quotes WHERE id = ?")
 	if err != nil {
 		return nil, err
@@ -50,7 +50,7 @@ func (q *QuotesDB) getQuote(id string) (*Quote, error) {
 	return quote, err
 }
 
-func (q *QuotesDB) getRandomQuote() (*Quote, error) {
+func (q *QuotesDB) GetRandomQuote() (*Quote, error) {
 	quote := &Quote{}
 	row := q.db.QueryRow("SELECT id, author, quote, karma FROM quotes ORDER BY RANDOM() LIMIT 1")
 	err := row.Scan(&quote.Id, &quote.Author, &quote.Quote, &quote.Karma)
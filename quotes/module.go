@@ -0,0 +1,101 @@
+package quotes
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/piger/dulbecco"
+	"log"
+)
+
+func init() {
+	dulbecco.RegisterPlugin("quotes", func() dulbecco.Plugin { return &quotesPlugin{} })
+}
+
+// The "quotes" module answers the same commands as the external
+// quotes-plugin without forking a process for each request (shown with the
+// default command prefix):
+//
+//	!q              a random quote
+//	!q <id>         the quote <id>
+//	!addq <quote>   add a new quote
+//	!s <terms>      search the quotes
+type quotesPlugin struct {
+	qdb *QuotesDB
+}
+
+func (p *quotesPlugin) Name() string {
+	return "quotes"
+}
+
+func (p *quotesPlugin) Init(bot *dulbecco.Bot) error {
+	config := bot.Config().Quotes
+	if config.DbFile == "" || config.IndexDir == "" {
+		return errors.New("you must specify a dbfile and an indexdir")
+	}
+
+	p.qdb = &QuotesDB{DbFile: config.DbFile, IndexDir: config.IndexDir}
+	return p.qdb.Open()
+}
+
+func (p *quotesPlugin) Shutdown() {
+	p.qdb.Close()
+}
+
+func (p *quotesPlugin) Handle(event *dulbecco.Event) {
+	message, c := event.Message, event.Conn
+	if message.Cmd != "PRIVMSG" {
+		return
+	}
+
+	text, _ := message.Arg(1)
+	command, args, ok := c.Settings(message.Channel()).ParseCommand(text)
+	if !ok {
+		return
+	}
+	target := message.ReplyTarget()
+
+	switch command {
+	case "q":
+		var quote *Quote
+		var err error
+		if args == "" {
+			quote, err = p.qdb.GetRandomQuote()
+		} else {
+			quote, err = p.qdb.GetQuote(args)
+		}
+		if err == sql.ErrNoRows {
+			c.Privmsg(target, "Te stai popo che a sbàja")
+		} else if err != nil {
+			log.Print("error getting quote: ", err)
+		} else {
+			c.Privmsgf(target, "%d: %s", quote.Id, quote.Quote)
+		}
+	case "addq":
+		if args == "" {
+			return
+		}
+		id, err := p.qdb.AddQuote(message.Nick, args)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		c.Privmsgf(target, "Added quote %d", id)
+	case "s":
+		if args == "" {
+			return
+		}
+		result, err := p.qdb.SearchQuotes(args, 1)
+		if err != nil {
+			log.Print("error searching quotes: ", err)
+			return
+		}
+		if len(result.Quotes) == 0 {
+			c.Privmsg(target, "No matches")
+			return
+		}
+		c.Privmsgf(target, "%d matches, showing page 1 of %d", result.Total, result.Pages)
+		for _, quote := range result.Quotes {
+			c.Privmsgf(target, "%d: %s", quote.Id, quote.Quote)
+		}
+	}
+}
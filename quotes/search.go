@@ -6,6 +6,7 @@ import (
 	"github.com/blevesearch/bleve"
 	"github.com/codegangsta/cli"
 	"math"
+	"strconv"
 	"strings"
 )
 
@@ -23,8 +24,36 @@ func CmdSearch(ctx *cli.Context) {
 }
 
 func (q *QuotesDB) searchQuote(qstring string, page int) error {
+	result, err := q.SearchQuotes(qstring, page)
+	if err != nil {
+		return err
+	}
+
+	if len(result.Quotes) > 0 {
+		fmt.Printf("%d matches, showing page %d of %d\n", result.Total, page, result.Pages)
+
+		for _, quote := range result.Quotes {
+			fmt.Printf("%d: %s\n", quote.Id, quote.Quote)
+		}
+	} else {
+		fmt.Println("No matches")
+	}
+
+	return nil
+}
+
+// A page of search results.
+type SearchResult struct {
+	Total  uint64
+	Pages  int
+	Quotes []*Quote
+}
+
+// Search the quotes matching qstring, returning the requested page of
+// results; only the quote ID and text are set.
+func (q *QuotesDB) SearchQuotes(qstring string, page int) (*SearchResult, error) {
 	if page < 1 {
-		return errors.New("Invalid page requested")
+		return nil, errors.New("Invalid page requested")
 	}
 	// query := bleve.NewQueryStringQuery(qstring)
 	query := bleve.NewMatchQuery(qstring).SetField("quote")
@@ -34,21 +63,21 @@ func (q *QuotesDB) searchQuote(qstring string, page int) error {
 	request.Fields = append(request.Fields, []string{"id", "quote"}...)
 	results, err := q.idx.Search(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(results.Hits) > 0 {
-		totPages := int(math.Ceil(float64(results.Total) / float64(maxResultsPerSearch)))
-		fmt.Printf("%d matches, showing page %d of %d\n", results.Total, page, totPages)
-
-		for _, hit := range results.Hits {
-			fmt.Printf("%s: %s\n", hit.ID, hit.Fields["quote"])
+	result := &SearchResult{
+		Total: results.Total,
+		Pages: int(math.Ceil(float64(results.Total) / float64(maxResultsPerSearch))),
+	}
+	for _, hit := range results.Hits {
+		id, err := strconv.Atoi(hit.ID)
+		if err != nil {
+			continue
 		}
-
-		// fmt.Println(results)
-	} else {
-		fmt.Println("No matches")
+		text, _ := hit.Fields["quote"].(string)
+		result.Quotes = append(result.Quotes, &Quote{Id: id, Quote: text})
 	}
 
-	return nil
+	return result, nil
 }
@@ -0,0 +1,153 @@
+package dulbecco
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Outputs sharing at least this fraction of their words with a recent one
+// are near duplicates of it.
+const repeatSimilarity = 0.8
+
+// recentOutputs is a ring buffer of the latest outputs of the bot in a
+// channel.
+type recentOutputs struct {
+	ring []string
+	// the oldest line, once the ring is full
+	next int
+	size int
+}
+
+// Remember line, keeping only the latest size lines.
+func (r *recentOutputs) add(line string, size int) {
+	if size != r.size {
+		r.resize(size)
+	}
+	if size <= 0 {
+		return
+	}
+	if len(r.ring) < size {
+		r.ring = append(r.ring, line)
+		return
+	}
+	r.ring[r.next] = line
+	r.next = (r.next + 1) % size
+}
+
+// Returns the remembered lines, the oldest first.
+func (r *recentOutputs) lines() []string {
+	return append(append([]string(nil), r.ring[r.next:]...), r.ring[:r.next]...)
+}
+
+func (r *recentOutputs) resize(size int) {
+	lines := r.lines()
+	if size < 0 {
+		size = 0
+	}
+	if len(lines) > size {
+		lines = lines[len(lines)-size:]
+	}
+	r.ring, r.next, r.size = lines, 0, size
+}
+
+// recentMemory holds the recent outputs of every channel, by key; see
+// channelKey.
+type recentMemory struct {
+	mu       sync.Mutex
+	channels map[string]*recentOutputs
+}
+
+// Returns the latest outputs for key, the oldest first.
+func (m *recentMemory) lines(key string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.channels[key]; ok {
+		return r.lines()
+	}
+	return nil
+}
+
+// Remember line among the latest size outputs for key.
+func (m *recentMemory) add(key, line string, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.channels == nil {
+		m.channels = make(map[string]*recentOutputs)
+	}
+	r, ok := m.channels[key]
+	if !ok {
+		r = &recentOutputs{}
+		m.channels[key] = r
+	}
+	r.add(line, size)
+}
+
+// Returns true if line is the same as, or very similar to, one of the latest
+// outputs for key.
+func (m *recentMemory) repeats(key, line string) bool {
+	for _, recent := range m.lines(key) {
+		if nearDuplicate(line, recent) {
+			return true
+		}
+	}
+	return false
+}
+
+// Minimum number of words of a recent output for echoes.
+const minEchoWords = 3
+
+// Returns true if text contains one of the latest outputs for key, i.e. it
+// was relayed by another bot.
+func (m *recentMemory) echoes(key, text string) bool {
+	text = strings.ToLower(text)
+	for _, recent := range m.lines(key) {
+		if len(phraseWords(recent)) >= minEchoWords && strings.Contains(text, strings.ToLower(recent)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if a and b are the same phrase, ignoring case and
+// punctuation, or have almost the same words.
+func nearDuplicate(a, b string) bool {
+	wordsA, wordsB := phraseWords(a), phraseWords(b)
+	var common int
+	for word := range wordsA {
+		if wordsB[word] {
+			common++
+		}
+	}
+	union := len(wordsA) + len(wordsB) - common
+	if union == 0 {
+		return strings.TrimSpace(a) == strings.TrimSpace(b)
+	}
+	return float64(common)/float64(union) >= repeatSimilarity
+}
+
+func phraseWords(s string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		words[word] = true
+	}
+	return words
+}
+
+// Returns a line of replies, drawn from r, for which avoid returns false, or
+// any of them if they must all be avoided.
+func pickReply(r *rand.Rand, replies []string, avoid func(string) bool) string {
+	var fresh []string
+	for _, reply := range replies {
+		if avoid == nil || !avoid(reply) {
+			fresh = append(fresh, reply)
+		}
+	}
+	if len(fresh) == 0 {
+		fresh = replies
+	}
+	return fresh[r.Intn(len(fresh))]
+}
@@ -0,0 +1,49 @@
+package dulbecco
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestRecentOutputs(t *testing.T) {
+	var m recentMemory
+	for _, line := range []string{"one", "two", "three", "four"} {
+		m.add("local #pizza", line, 3)
+	}
+	if lines := m.lines("local #pizza"); !reflect.DeepEqual(lines, []string{"two", "three", "four"}) {
+		t.Fatalf("lines = %q", lines)
+	}
+	// a smaller window keeps the latest lines
+	m.add("local #pizza", "five", 2)
+	if lines := m.lines("local #pizza"); !reflect.DeepEqual(lines, []string{"four", "five"}) {
+		t.Fatalf("lines after resize = %q", lines)
+	}
+	if m.lines("local #fun") != nil {
+		t.Fatal("channels must not share their outputs")
+	}
+
+	m.add("local #fun", "I like pizza with pineapple", 10)
+	for line, expected := range map[string]bool{
+		"I like pizza with pineapple":  true,
+		"i like PIZZA with pineapple!": true,
+		"I like pizza":                 false,
+		"something else":               false,
+	} {
+		if m.repeats("local #fun", line) != expected {
+			t.Errorf("repeats(%q) should be %v", line, expected)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	replies := []string{"boh", "mah"}
+	for i := 0; i < 10; i++ {
+		if reply := pickReply(r, replies, func(s string) bool { return s == "boh" }); reply != "mah" {
+			t.Fatalf("pickReply() = %q", reply)
+		}
+	}
+	// when every reply must be avoided one is returned anyway
+	if reply := pickReply(r, replies, func(string) bool { return true }); reply == "" {
+		t.Fatal("pickReply() returned nothing")
+	}
+}
@@ -0,0 +1,404 @@
+package dulbecco
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Policies for jobs firing while disconnected.
+const (
+	MissedSkip = "skip"
+	MissedRun  = "run"
+)
+
+// A Schedule returns the next activation time after t, or the zero time if
+// there are none.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// Standard cron expression: minute, hour, day of month, month and day of
+// week; each field is a bitmask of the allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// true if the day of month or day of week fields are "*"
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse a job schedule: exactly one of cron and interval must be set.
+func ParseSchedule(cron, interval string) (Schedule, error) {
+	if cron != "" && interval != "" {
+		return nil, errors.New("both cron and interval are set")
+	} else if cron != "" {
+		return parseCron(cron)
+	} else if interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid interval %q", interval)
+		}
+		return intervalSchedule(d), nil
+	}
+	return nil, errors.New("no cron or interval defined")
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", spec)
+	}
+
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// both 0 and 7 are sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = strings.HasPrefix(fields[2], "*")
+	s.dowAny = strings.HasPrefix(fields[4], "*")
+
+	return &s, nil
+}
+
+// Parse a cron field like "*", "*/15", "1-5", "0,30" or "10-20/2".
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			n, err := strconv.Atoi(part[slash+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in cron field %q", field)
+			}
+			step, part = n, part[:slash]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			var err1, err2 error
+			if dash := strings.Index(part, "-"); dash >= 0 {
+				lo, err1 = strconv.Atoi(part[:dash])
+				hi, err2 = strconv.Atoi(part[dash+1:])
+			} else {
+				lo, err1 = strconv.Atoi(part)
+				// "5/10" means "from 5 to the end every 10"
+				if step == 1 {
+					hi = lo
+				}
+			}
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid cron field %q", field)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("cron field %q out of range %d-%d", field, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	// an impossible expression like "0 0 31 2 *" never matches
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Like cron, when both the day of month and the day of week are restricted
+// a day matching either of them is accepted.
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// A scheduled job.
+type Job struct {
+	JobConfiguration
+	schedule Schedule
+
+	// next activation time
+	next time.Time
+}
+
+// Data available to the Command and Message templates of a job.
+type JobData struct {
+	Job      string
+	Server   string
+	Channel  string
+	Nickname string
+	Time     time.Time
+}
+
+// Returns true if the job sends its output to the named server.
+func (job *Job) AllowServer(name string) bool {
+	return allowName(name, job.Servers, nil)
+}
+
+// The Scheduler runs jobs on all the bot connections.
+type Scheduler struct {
+	bot  *Bot
+	jobs []*Job
+	quit chan bool
+	mu   sync.Mutex
+}
+
+func NewScheduler(bot *Bot, jobs []JobConfiguration) *Scheduler {
+	s := &Scheduler{bot: bot}
+
+	for _, config := range jobs {
+		schedule, err := ParseSchedule(config.Cron, config.Interval)
+		if err != nil {
+			log.Printf("Invalid schedule for job '%s': %s", config.Name, err)
+			continue
+		}
+		s.jobs = append(s.jobs, &Job{JobConfiguration: config, schedule: schedule})
+	}
+
+	return s
+}
+
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.quit = make(chan bool)
+	for _, job := range s.jobs {
+		go s.loop(job, s.quit)
+	}
+}
+
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.quit != nil {
+		close(s.quit)
+		s.quit = nil
+	}
+}
+
+func (s *Scheduler) loop(job *Job, quit chan bool) {
+	for {
+		now := time.Now()
+		next := job.schedule.Next(now)
+		if next.IsZero() {
+			log.Printf("Job '%s' will never run again", job.Name)
+			return
+		}
+		s.mu.Lock()
+		job.next = next
+		s.mu.Unlock()
+
+		select {
+		case <-time.After(next.Sub(now)):
+			s.Run(job)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Returns all the jobs.
+func (s *Scheduler) Jobs() []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]*Job, len(s.jobs))
+	copy(jobs, s.jobs)
+	return jobs
+}
+
+// Returns the next activation time of a job, or the zero time if the
+// scheduler is not running.
+func (s *Scheduler) NextRun(job *Job) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.quit == nil {
+		return time.Time{}
+	}
+	return job.next
+}
+
+// Returns the named job, or nil.
+func (s *Scheduler) Job(name string) *Job {
+	for _, job := range s.Jobs() {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+// Run a job on all its servers, following the job policy for servers we are
+// not connected to.
+func (s *Scheduler) Run(job *Job) {
+	log.Printf("Running job '%s'", job.Name)
+
+	for _, conn := range s.bot.Connections() {
+		name := conn.Config().Name
+		if !job.AllowServer(name) {
+			continue
+		}
+		// get a copy for the closure
+		c := conn
+
+		if job.Missed == MissedRun {
+			for _, channel := range c.jobChannels(job) {
+				channel := channel
+				run := func() { c.runJobIn(job, channel) }
+				if !c.RunOrQueue(channel, job.Name, run) {
+					log.Printf("Job '%s' queued until %s joins %s", job.Name, name, channel)
+				}
+			}
+		} else if c.Connected() {
+			c.runJob(job)
+		} else {
+			log.Printf("Job '%s' skipped for %s: not connected", job.Name, name)
+		}
+	}
+}
+
+// Returns the channels of this server a job sends its output to; when a job
+// has no channels it uses all the configured channels.
+func (c *Connection) jobChannels(job *Job) []string {
+	var channels []string
+	for _, channel := range c.Config().Channels {
+		if allowName(channel, job.Channels, nil) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Send the output of a job to its channels on this server.
+func (c *Connection) runJob(job *Job) {
+	for _, channel := range c.jobChannels(job) {
+		c.runJobIn(job, channel)
+	}
+}
+
+// Send the output of a job to channel.
+func (c *Connection) runJobIn(job *Job, channel string) {
+	server := c.Config().Name
+	data := &JobData{
+		Job:      job.Name,
+		Server:   server,
+		Channel:  channel,
+		Nickname: c.nickname,
+		Time:     time.Now(),
+	}
+
+	if job.Message != "" {
+		if text, err := expandTemplate(job.Message, data); err != nil {
+			log.Printf("Cannot expand message for job '%s': %s", job.Name, err)
+		} else {
+			c.Privmsg(channel, text)
+		}
+	}
+
+	if job.Command != "" {
+		cmdline, err := expandTemplate(job.Command, data)
+		if err != nil {
+			log.Printf("Cannot expand command for job '%s': %s", job.Name, err)
+			return
+		}
+		event := &PluginEvent{
+			Plugin:      job.Name,
+			Command:     "JOB",
+			Timestamp:   data.Time,
+			Channel:     channel,
+			Target:      channel,
+			BotNickname: c.nickname,
+			Server:      server,
+			Permission:  PermissionUser,
+		}
+		plugin := PluginConfiguration{Name: job.Name, Output: job.Output}
+		c.runPlugin(plugin, cmdline, event)
+	}
+}
+
+func expandTemplate(text string, data interface{}) (string, error) {
+	tpl, err := template.New("job").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,73 @@
+package dulbecco
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// a wednesday
+	now := time.Date(2015, time.March, 4, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2015, time.March, 4, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, time.March, 4, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2015, time.March, 5, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2015, time.March, 5, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 0", time.Date(2015, time.March, 8, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2015, time.March, 8, 9, 0, 0, 0, time.UTC)},
+		{"30 8 1 * *", time.Date(2015, time.April, 1, 8, 30, 0, 0, time.UTC)},
+		{"0 0 1,15 * 1", time.Date(2015, time.March, 9, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.spec)
+		if err != nil {
+			t.Fatalf("%q: %s", test.spec, err)
+		}
+		if next := schedule.Next(now); !next.Equal(test.expected) {
+			t.Errorf("%q: expected %s, got %s", test.spec, test.expected, next)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestRunOrQueue(t *testing.T) {
+	c := &Connection{}
+	runs := make(map[string]int)
+	for _, name := range []string{"a", "b", "a", "a"} {
+		name := name
+		if c.RunOrQueue("#pizza", name, func() { runs[name]++ }) {
+			t.Fatal("RunOrQueue() ran a job outside of the channel")
+		}
+	}
+	c.runPending("#fun")
+	if len(runs) != 0 {
+		t.Fatalf("runs = %v, expected the jobs to wait for #pizza", runs)
+	}
+	c.setJoined("#Pizza", true)
+	c.runPending("#Pizza")
+	if runs["a"] != 1 || runs["b"] != 1 {
+		t.Fatalf("runs = %v, expected one run per job", runs)
+	}
+	if !c.RunOrQueue("#pizza", "a", func() { runs["a"]++ }) || runs["a"] != 2 {
+		t.Fatal("RunOrQueue() must run jobs in the channels we are in")
+	}
+	c.setConnected(false)
+	if c.RunOrQueue("#pizza", "a", func() {}) {
+		t.Fatal("RunOrQueue() must queue jobs after a disconnection")
+	}
+}
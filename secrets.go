@@ -0,0 +1,195 @@
+package dulbecco
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Prefix of configuration values read from a file.
+const filePrefix = "file:"
+
+// What Dump writes in place of secrets.
+const maskedSecret = "********"
+
+// Matches "${NAME}" and the escaped "$${NAME}".
+var reEnvVar = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Resolve references to secrets in every string field of the configuration:
+//
+//	"${IRC_PASSWORD}"        is replaced by the IRC_PASSWORD environment variable
+//	"file:/run/secrets/irc"  is replaced by the (trimmed) contents of the file
+//
+// Environment variables can be used anywhere inside a value, while "file:" must
+// be at the beginning of it. "$${NAME}" and "file::" are written as the
+// literal "${NAME}" and "file:". All the missing variables and files are
+// reported.
+func (config *Configuration) resolveSecrets() error {
+	v := &validator{filename: config.filename, secrets: make(map[string]bool)}
+	v.resolveValue("", reflect.ValueOf(config).Elem())
+	config.secrets = v.secrets
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+func (v *validator) resolveValue(field string, value reflect.Value) {
+	switch value.Kind() {
+	case reflect.String:
+		if !value.CanSet() {
+			return
+		}
+		if resolved, ok := v.resolveString(field, value.String()); ok {
+			value.SetString(resolved)
+		}
+	case reflect.Struct:
+		t := value.Type()
+		for i := 0; i < value.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				// unexported
+				continue
+			}
+			v.resolveValue(joinField(field, configFieldName(t.Field(i))), value.Field(i))
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			v.resolveValue(fmt.Sprintf("%s[%d]", field, i), value.Index(i))
+		}
+	case reflect.Ptr:
+		if !value.IsNil() {
+			v.resolveValue(field, value.Elem())
+		}
+	case reflect.Map:
+		// map values are not addressable: resolve a copy and store it back
+		for _, key := range value.MapKeys() {
+			elem := reflect.New(value.Type().Elem()).Elem()
+			elem.Set(value.MapIndex(key))
+			v.resolveValue(fmt.Sprintf("%s[%q]", field, key.String()), elem)
+			value.SetMapIndex(key, elem)
+		}
+	}
+}
+
+func (v *validator) resolveString(field, s string) (string, bool) {
+	ok, secret := true, false
+	s = reEnvVar.ReplaceAllStringFunc(s, func(ref string) string {
+		match := reEnvVar.FindStringSubmatch(ref)
+		if match[1] != "" {
+			// escaped
+			return ref[1:]
+		}
+		name := match[2]
+		secret = true
+		value, found := os.LookupEnv(name)
+		if !found {
+			v.errorf(field, "environment variable %s is not set", name)
+			ok = false
+		}
+		return value
+	})
+	if !ok {
+		return "", false
+	}
+
+	if strings.HasPrefix(s, filePrefix+":") {
+		// escaped
+		s = filePrefix + s[len(filePrefix)+1:]
+	} else if strings.HasPrefix(s, filePrefix) {
+		filename := strings.TrimPrefix(s, filePrefix)
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			v.errorf(field, "cannot read secret: %s", err)
+			return "", false
+		}
+		s = strings.TrimSpace(string(data))
+		secret = true
+	}
+
+	if secret {
+		v.secrets[field] = true
+	}
+	return s, true
+}
+
+// Mark dstField as a secret where srcField, or one of its elements, is one;
+// used when dstField inherits the value of srcField.
+func (config *Configuration) inheritSecrets(dstField, srcField string) {
+	var inherited []string
+	for field := range config.secrets {
+		if field == srcField || strings.HasPrefix(field, srcField+".") || strings.HasPrefix(field, srcField+"[") {
+			inherited = append(inherited, dstField+strings.TrimPrefix(field, srcField))
+		}
+	}
+	for _, field := range inherited {
+		config.secrets[field] = true
+	}
+}
+
+// Returns a copy of value where the non empty strings resolved from a secret
+// reference are masked; the values of the configuration are left untouched.
+func (config *Configuration) maskValue(field string, value reflect.Value) reflect.Value {
+	switch value.Kind() {
+	case reflect.String:
+		if config.secrets[field] && value.String() != "" {
+			masked := reflect.New(value.Type()).Elem()
+			masked.SetString(maskedSecret)
+			return masked
+		}
+	case reflect.Struct:
+		t := value.Type()
+		masked := reflect.New(t).Elem()
+		masked.Set(value)
+		for i := 0; i < value.NumField(); i++ {
+			if t.Field(i).PkgPath == "" {
+				masked.Field(i).Set(config.maskValue(joinField(field, configFieldName(t.Field(i))), value.Field(i)))
+			}
+		}
+		return masked
+	case reflect.Slice:
+		if value.IsNil() {
+			return value
+		}
+		masked := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		for i := 0; i < value.Len(); i++ {
+			masked.Index(i).Set(config.maskValue(fmt.Sprintf("%s[%d]", field, i), value.Index(i)))
+		}
+		return masked
+	case reflect.Ptr:
+		if value.IsNil() {
+			return value
+		}
+		masked := reflect.New(value.Type().Elem())
+		masked.Elem().Set(config.maskValue(field, value.Elem()))
+		return masked
+	case reflect.Map:
+		if value.IsNil() {
+			return value
+		}
+		masked := reflect.MakeMap(value.Type())
+		for _, key := range value.MapKeys() {
+			masked.SetMapIndex(key, config.maskValue(fmt.Sprintf("%s[%q]", field, key.String()), value.MapIndex(key)))
+		}
+		return masked
+	}
+	return value
+}
+
+// Returns the name of a field as written in the configuration file.
+func configFieldName(sf reflect.StructField) string {
+	if tag := sf.Tag.Get("toml"); tag != "" && tag != "-" {
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(sf.Name)
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
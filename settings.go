@@ -0,0 +1,242 @@
+package dulbecco
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Settings can be set globally, per server and per channel; fields left unset
+// are inherited in the order channel > server > global.
+type Settings struct {
+	// names of the enabled plugins and modules; nil means all of them.
+	Plugins []string
+	Replies []string
+	// learn from the messages and reply with markov generated phrases
+	MarkovLearn *bool `json:"markov_learn" toml:"markov_learn"`
+	MarkovSpeak *bool `json:"markov_speak" toml:"markov_speak"`
+	// the markov corpus learned from and spoken from; "" is the default
+	// corpus
+	MarkovCorpus *string `json:"markov_corpus" toml:"markov_corpus"`
+	// speak from several corpora, with the given weights, instead of
+	// markov_corpus alone
+	MarkovBlend map[string]float64 `json:"markov_blend" toml:"markov_blend"`
+	// probability of replying to messages not directed to us (0-1)
+	ReplyProbability *float64 `json:"reply_probability" toml:"reply_probability"`
+	// words that always get a reply, like our nickname, but without
+	// addressing the sender
+	ReplyTriggers []string `json:"reply_triggers" toml:"reply_triggers"`
+	// minimum time between replies to messages not directed to us, i.e.
+	// "10m"
+	ReplyCooldown *string `json:"reply_cooldown" toml:"reply_cooldown"`
+	// hours of the day, in local time, without replies to messages not
+	// directed to us, i.e. "23:00-08:00"
+	QuietHours *string `json:"quiet_hours" toml:"quiet_hours"`
+	// the number of latest outputs of the bot in a channel that its markov
+	// and canned replies must not repeat, 10 by default; 0 disables it
+	RepeatWindow *int `json:"repeat_window" toml:"repeat_window"`
+	// prefix of bot commands, "!" by default
+	CommandPrefix *string `json:"command_prefix" toml:"command_prefix"`
+	// language of the channel, passed to plugins and modules
+	Language *string
+}
+
+// The settings in effect for a channel.
+type EffectiveSettings struct {
+	Plugins          []string
+	Replies          []string
+	MarkovLearn      bool
+	MarkovSpeak      bool
+	MarkovCorpus     string
+	MarkovBlend      map[string]float64
+	ReplyProbability float64
+	ReplyTriggers    []string
+	ReplyCooldown    time.Duration
+	QuietHours       string
+	RepeatWindow     int
+	CommandPrefix    string
+	Language         string
+}
+
+// Default values for settings not defined anywhere.
+var defaultSettings = EffectiveSettings{
+	MarkovLearn:   true,
+	MarkovSpeak:   true,
+	RepeatWindow:  10,
+	CommandPrefix: "!",
+}
+
+// Overwrite the fields of es with the fields set in s.
+func (es *EffectiveSettings) apply(s *Settings) {
+	if s.Plugins != nil {
+		es.Plugins = s.Plugins
+	}
+	if s.Replies != nil {
+		es.Replies = s.Replies
+	}
+	if s.MarkovLearn != nil {
+		es.MarkovLearn = *s.MarkovLearn
+	}
+	if s.MarkovSpeak != nil {
+		es.MarkovSpeak = *s.MarkovSpeak
+	}
+	if s.MarkovCorpus != nil {
+		es.MarkovCorpus = *s.MarkovCorpus
+	}
+	if s.MarkovBlend != nil {
+		es.MarkovBlend = s.MarkovBlend
+	}
+	if s.ReplyProbability != nil {
+		es.ReplyProbability = *s.ReplyProbability
+	}
+	if s.ReplyTriggers != nil {
+		es.ReplyTriggers = s.ReplyTriggers
+	}
+	if s.ReplyCooldown != nil {
+		// it has been validated when reading the configuration
+		es.ReplyCooldown, _ = time.ParseDuration(*s.ReplyCooldown)
+	}
+	if s.QuietHours != nil {
+		es.QuietHours = *s.QuietHours
+	}
+	if s.RepeatWindow != nil {
+		es.RepeatWindow = *s.RepeatWindow
+	}
+	if s.CommandPrefix != nil {
+		es.CommandPrefix = *s.CommandPrefix
+	}
+	if s.Language != nil {
+		es.Language = *s.Language
+	}
+}
+
+// Returns true if the named plugin or module is enabled.
+func (es *EffectiveSettings) PluginEnabled(name string) bool {
+	return es.Plugins == nil || containsName(es.Plugins, name)
+}
+
+// Returns true if text is a bot command, i.e. it starts with the command
+// prefix.
+func (es *EffectiveSettings) IsCommand(text string) bool {
+	return strings.HasPrefix(text, es.CommandPrefix)
+}
+
+// Split a command into its name, without the prefix, and its arguments; ok is
+// false if text is not a command.
+func (es *EffectiveSettings) ParseCommand(text string) (name, args string, ok bool) {
+	if !es.IsCommand(text) {
+		return "", "", false
+	}
+	fields := strings.SplitN(text[len(es.CommandPrefix):], " ", 2)
+	if fields[0] == "" {
+		return "", "", false
+	}
+	if len(fields) > 1 {
+		args = strings.TrimSpace(fields[1])
+	}
+	return fields[0], args, true
+}
+
+// Returns true if text contains one of the reply triggers as a whole word,
+// ignoring case.
+func (es *EffectiveSettings) IsTriggered(text string) bool {
+	text = strings.ToLower(text)
+	for _, trigger := range es.ReplyTriggers {
+		if trigger != "" && containsWord(text, strings.ToLower(trigger)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if word is in text and is not part of a longer word.
+func containsWord(text, word string) bool {
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], word)
+		if i < 0 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(word)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// Returns true if t is within the quiet hours.
+func (es *EffectiveSettings) IsQuiet(t time.Time) bool {
+	if es.QuietHours == "" {
+		return false
+	}
+	start, end, err := parseQuietHours(es.QuietHours)
+	if err != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	// i.e. 23:00-08:00
+	return now >= start || now < end
+}
+
+// Parse a "HH:MM-HH:MM" range into minutes since midnight.
+func parseQuietHours(s string) (start, end int, err error) {
+	fields := strings.Split(s, "-")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q, expected HH:MM-HH:MM", s)
+	}
+	var minutes [2]int
+	for i, field := range fields {
+		t, err := time.Parse("15:04", strings.TrimSpace(field))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time %q, expected HH:MM", field)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// Returns a reply among the configured ones, drawn from r, preferring the
+// ones for which avoid returns false; avoid can be nil.
+func (es *EffectiveSettings) RandomReply(r *rand.Rand, avoid func(string) bool) string {
+	if len(es.Replies) > 0 {
+		return pickReply(r, es.Replies, avoid)
+	}
+	return randomReply(r, avoid)
+}
+
+// Returns the settings in effect for a channel of server; channel can be
+// empty for private messages.
+func (config *Configuration) Resolve(server *ServerConfiguration, channel string) *EffectiveSettings {
+	es := defaultSettings
+	es.Replies = config.Replies
+	es.apply(&config.Settings)
+	es.apply(&server.Settings)
+	if channel != "" {
+		for name, s := range server.ChannelSettings {
+			if strings.EqualFold(name, channel) {
+				es.apply(&s)
+				break
+			}
+		}
+	}
+	return &es
+}
+
+// Returns the settings in effect for a channel of this connection; it can
+// only be called by callbacks and modules.
+func (c *Connection) Settings(channel string) *EffectiveSettings {
+	config := c.Config()
+	return c.bot.Config().Resolve(&config, channel)
+}
@@ -0,0 +1,344 @@
+package dulbecco
+
+import (
+	"fmt"
+	"github.com/piger/dulbecco/irclog"
+	"github.com/piger/dulbecco/markov"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	reNickname = regexp.MustCompile("^[A-Za-z\\[\\]\\\\`_^{|}][A-Za-z0-9\\[\\]\\\\`_^{|}-]*$")
+
+	validOutputs   = []string{"", OutputText, OutputDirectives, OutputJSON}
+	validScopes    = []string{"", ScopePrivate, ScopeChannel}
+	validMissed    = []string{"", MissedSkip, MissedRun}
+	validEvents    = []string{"PRIVMSG", "ACTION", "NOTICE", "JOIN", "PART", "KICK", "TOPIC", "NICK", "INVITE", "QUIT", TimerEvent}
+	reNumericReply = regexp.MustCompile(`^\d{3}$`)
+)
+
+// A problem with a configuration field.
+type FieldError struct {
+	Filename string
+	// the path of the field, i.e. "server[0].nickname"
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	if e.Filename != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Filename, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationError contains all the problems found by Validate.
+type ValidationError []*FieldError
+
+func (ve ValidationError) Error() string {
+	var msgs []string
+	for _, e := range ve {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+type validator struct {
+	filename string
+	errors   ValidationError
+	// the fields resolved from secret references, see resolveSecrets
+	secrets map[string]bool
+}
+
+func (v *validator) errorf(field, format string, a ...interface{}) {
+	v.errors = append(v.errors, &FieldError{v.filename, field, fmt.Sprintf(format, a...)})
+}
+
+func (v *validator) required(field, value string) bool {
+	if value == "" {
+		v.errorf(field, "required field is missing")
+		return false
+	}
+	return true
+}
+
+func (v *validator) oneOf(field, value string, valid []string) {
+	for _, s := range valid {
+		if value == s {
+			return
+		}
+	}
+	v.errorf(field, "invalid value %q (valid values: %s)", value, strings.Join(valid[1:], ", "))
+}
+
+func (v *validator) address(field, address string) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		v.errorf(field, "invalid address %q: %s", address, err)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		v.errorf(field, "invalid port in address %q", address)
+	}
+}
+
+func (v *validator) channels(field string, channels []string) {
+	for i, channel := range channels {
+		if !isValidChannel(channel) {
+			v.errorf(fmt.Sprintf("%s[%d]", field, i), "invalid channel name %q", channel)
+		}
+	}
+}
+
+func (v *validator) template(field, text string) {
+	if _, err := template.New(field).Parse(text); err != nil {
+		v.errorf(field, "invalid template: %s", err)
+	}
+}
+
+// Channel names must start with a channel prefix and can't contain spaces,
+// commas or ^G (RFC 2812, 1.3).
+func isValidChannel(name string) bool {
+	return isChannelName(name) && len(name) > 1 && len(name) <= 50 &&
+		!strings.ContainsAny(name, " ,\a")
+}
+
+// Validate checks the whole configuration and returns a ValidationError with
+// all the problems found, or nil.
+func (config *Configuration) Validate() error {
+	v := &validator{filename: config.filename}
+
+	if len(config.Servers) < 1 {
+		v.errorf("server", "no servers defined")
+	}
+
+	names := make(map[string]int)
+	for i, server := range config.Servers {
+		v.validateServer(fmt.Sprintf("server[%d]", i), &server)
+		if prev, dup := names[server.Name]; dup && server.Name != "" {
+			v.errorf(fmt.Sprintf("server[%d].name", i), "duplicate server name %q (see server[%d])", server.Name, prev)
+		} else {
+			names[server.Name] = i
+		}
+	}
+
+	for i, plugin := range config.Plugins {
+		v.validatePlugin(fmt.Sprintf("plugin[%d]", i), &plugin)
+	}
+
+	jobs := make(map[string]int)
+	for i, job := range config.Jobs {
+		field := fmt.Sprintf("job[%d]", i)
+		v.validateJob(field, &job)
+		if prev, dup := jobs[job.Name]; dup && job.Name != "" {
+			v.errorf(field+".name", "duplicate job name %q (see job[%d])", job.Name, prev)
+		} else {
+			jobs[job.Name] = i
+		}
+	}
+
+	if config.Hipchat.Address != "" {
+		v.address("hipchat.address", config.Hipchat.Address)
+	}
+
+	if backends := markov.Backends(); !containsName(backends, config.Markov.GetBackend()) {
+		v.errorf("markov.backend", "unknown backend %q (available: %s)", config.Markov.GetBackend(), strings.Join(backends, ", "))
+	}
+	if opts := config.Markov.Options(); opts.Order < 1 {
+		v.errorf("markov.order", "must be at least 1")
+	} else if opts.MinOrder < 0 || opts.MinOrder > opts.Order {
+		v.errorf("markov.min_order", "must be between 0 (disabled) and order (%d)", opts.Order)
+	}
+	if tokenizers := markov.Tokenizers(); config.Markov.Tokenizer != "" && !containsName(tokenizers, config.Markov.Tokenizer) {
+		v.errorf("markov.tokenizer", "unknown tokenizer %q (available: %s)", config.Markov.Tokenizer, strings.Join(tokenizers, ", "))
+	}
+	if config.Markov.Temperature < 0 {
+		v.errorf("markov.temperature", "must not be negative")
+	}
+	if config.Markov.Candidates < 0 {
+		v.errorf("markov.candidates", "must not be negative")
+	}
+	if budget := config.Markov.Budget; budget != "" {
+		if d, err := time.ParseDuration(budget); err != nil || d <= 0 {
+			v.errorf("markov.budget", "invalid duration %q", budget)
+		}
+	}
+	for i, pattern := range config.Markov.Blocklist {
+		if _, err := regexp.Compile(pattern); err != nil {
+			v.errorf(fmt.Sprintf("markov.blocklist[%d]", i), "invalid regular expression %q: %s", pattern, err)
+		}
+	}
+
+	v.validateTraining("training", &config.Training)
+
+	// plugins and modules that can be enabled in the settings
+	plugins := RegisteredPlugins()
+	for _, plugin := range config.Plugins {
+		plugins = append(plugins, plugin.Name)
+	}
+	v.validateSettings("settings", &config.Settings, plugins)
+	for i, server := range config.Servers {
+		field := fmt.Sprintf("server[%d]", i)
+		v.validateSettings(field+".settings", &server.Settings, plugins)
+		for channel, settings := range server.ChannelSettings {
+			cfield := fmt.Sprintf("%s.channel[%q]", field, channel)
+			if !isValidChannel(channel) {
+				v.errorf(cfield, "invalid channel name %q", channel)
+			}
+			v.validateSettings(cfield, &settings, plugins)
+		}
+	}
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+func (v *validator) validateServer(field string, server *ServerConfiguration) {
+	v.required(field+".name", server.Name)
+	if v.required(field+".address", server.Address) {
+		v.address(field+".address", server.Address)
+	}
+	if v.required(field+".nickname", server.Nickname) && !reNickname.MatchString(server.Nickname) {
+		v.errorf(field+".nickname", "invalid nickname %q", server.Nickname)
+	}
+	for i, nick := range server.Altnicknames {
+		if !reNickname.MatchString(nick) {
+			v.errorf(fmt.Sprintf("%s.altnicknames[%d]", field, i), "invalid nickname %q", nick)
+		}
+	}
+	if v.required(field+".username", server.Username) && strings.ContainsAny(server.Username, " @") {
+		v.errorf(field+".username", "invalid username %q", server.Username)
+	}
+	v.required(field+".realname", server.Realname)
+	v.channels(field+".channels", server.Channels)
+
+	registered := RegisteredPlugins()
+	for i, name := range server.Modules {
+		if !containsName(registered, name) {
+			v.errorf(fmt.Sprintf("%s.modules[%d]", field, i), "unknown module %q (available: %s)",
+				name, strings.Join(registered, ", "))
+		}
+	}
+}
+
+func (v *validator) validatePlugin(field string, plugin *PluginConfiguration) {
+	v.required(field+".name", plugin.Name)
+	if v.required(field+".command", plugin.Command) {
+		v.template(field+".command", plugin.Command)
+	}
+	if _, err := regexp.Compile(plugin.Trigger); err != nil {
+		v.errorf(field+".trigger", "invalid regular expression: %s", err)
+	}
+	v.oneOf(field+".output", plugin.Output, validOutputs)
+	v.oneOf(field+".scope", plugin.Scope, validScopes)
+	v.channels(field+".channels", plugin.Channels)
+	v.channels(field+".exclude_channels", plugin.ExcludeChannels)
+
+	for i, event := range plugin.GetEvents() {
+		if !containsName(validEvents, event) && !reNumericReply.MatchString(event) {
+			v.errorf(fmt.Sprintf("%s.events[%d]", field, i), "unknown event %q", event)
+		}
+		if event == TimerEvent {
+			if d, err := time.ParseDuration(plugin.Interval); err != nil || d <= 0 {
+				v.errorf(field+".interval", "invalid interval %q for a TIMER plugin", plugin.Interval)
+			}
+		}
+	}
+}
+
+func (v *validator) validateJob(field string, job *JobConfiguration) {
+	v.required(field+".name", job.Name)
+	if _, err := ParseSchedule(job.Cron, job.Interval); err != nil {
+		// report the error under the field that was set
+		scheduleField := field + ".cron"
+		if job.Cron == "" && job.Interval != "" {
+			scheduleField = field + ".interval"
+		}
+		v.errorf(scheduleField, "invalid schedule: %s", err)
+	}
+	if job.Command == "" && job.Message == "" {
+		v.errorf(field, "one of command or message is required")
+	}
+	v.template(field+".command", job.Command)
+	v.template(field+".message", job.Message)
+	v.oneOf(field+".output", job.Output, validOutputs)
+	v.oneOf(field+".missed", job.Missed, validMissed)
+	v.channels(field+".channels", job.Channels)
+}
+
+func (v *validator) validateTraining(field string, training *TrainingConfiguration) {
+	if training.MinWords < 0 {
+		v.errorf(field+".min_words", "must not be negative")
+	}
+	if training.MaxWords < 0 {
+		v.errorf(field+".max_words", "must not be negative")
+	} else if training.MaxWords > 0 && training.MaxWords < training.MinWords {
+		v.errorf(field+".max_words", "must not be less than min_words (%d)", training.MinWords)
+	}
+	if training.MaxSymbols < 0 || training.MaxSymbols > 1 {
+		v.errorf(field+".max_symbols", "must be between 0 and 1")
+	}
+	languages := irclog.Languages()
+	for i, language := range training.Languages {
+		if !containsName(languages, language) {
+			v.errorf(fmt.Sprintf("%s.languages[%d]", field, i), "unknown language %q (available: %s)", language, strings.Join(languages, ", "))
+		}
+	}
+	if training.Dedup < 0 {
+		v.errorf(field+".dedup", "must not be negative")
+	}
+}
+
+func (v *validator) validateSettings(field string, settings *Settings, plugins []string) {
+	for i, name := range settings.Plugins {
+		if !containsName(plugins, name) {
+			v.errorf(fmt.Sprintf("%s.plugins[%d]", field, i), "unknown plugin or module %q", name)
+		}
+	}
+	if p := settings.ReplyProbability; p != nil && (*p < 0 || *p > 1) {
+		v.errorf(field+".reply_probability", "must be between 0 and 1")
+	}
+	if prefix := settings.CommandPrefix; prefix != nil && (*prefix == "" || strings.ContainsAny(*prefix, " \t")) {
+		v.errorf(field+".command_prefix", "invalid command prefix %q", *prefix)
+	}
+	for i, trigger := range settings.ReplyTriggers {
+		if strings.TrimSpace(trigger) == "" {
+			v.errorf(fmt.Sprintf("%s.reply_triggers[%d]", field, i), "empty trigger")
+		}
+	}
+	if cooldown := settings.ReplyCooldown; cooldown != nil {
+		if d, err := time.ParseDuration(*cooldown); err != nil || d < 0 {
+			v.errorf(field+".reply_cooldown", "invalid duration %q", *cooldown)
+		}
+	}
+	if hours := settings.QuietHours; hours != nil && *hours != "" {
+		if _, _, err := parseQuietHours(*hours); err != nil {
+			v.errorf(field+".quiet_hours", "%s", err)
+		}
+	}
+	if window := settings.RepeatWindow; window != nil && *window < 0 {
+		v.errorf(field+".repeat_window", "must not be negative")
+	}
+	if name := settings.MarkovCorpus; name != nil && *name != "" {
+		if err := markov.ValidCorpusName(*name); err != nil {
+			v.errorf(field+".markov_corpus", "%s", err)
+		}
+	}
+	for name, weight := range settings.MarkovBlend {
+		if name != "" {
+			if err := markov.ValidCorpusName(name); err != nil {
+				v.errorf(field+".markov_blend", "%s", err)
+			}
+		}
+		if weight < 0 {
+			v.errorf(fmt.Sprintf("%s.markov_blend.%s", field, name), "must not be negative")
+		}
+	}
+}